@@ -0,0 +1,106 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+)
+
+// This file contains the encoding of attribute values into the integers that credentials contain,
+// which depends on the version of the metadata attribute of the credential:
+//  - Before 0x03, an attribute is the integer whose big-endian bytes are its value.
+//  - From 0x03, the value is shifted left by one bit and the lowest bit is set,
+//    so that an integer of zero means that the (optional) attribute is absent.
+//  - From 0x04, values are shifted left by two bits and the lowest bit is set. If the value is
+//    longer than AttributeSize() it is replaced by its hash (see hashAttribute()) and the second
+//    lowest bit is set as well. The value itself, i.e. the preimage of the hash, is then kept
+//    next to the credential and sent along when the attribute is disclosed.
+// Attributes must be smaller than 2^Lm (see gabi.SystemParameters), otherwise the credential does
+// not hide them; before 0x04, larger values cannot be encoded correctly.
+
+// attributeHashLength is the amount of bytes of the SHA-256 hash of long values that is used
+// as attribute, such that it fits within the smallest attribute size of all key sizes.
+const attributeHashLength = 31
+
+var (
+	// ErrorMissingPreimage is returned when decoding an attribute whose value is replaced by its
+	// hash, without its value (i.e. the preimage of the hash) being available.
+	ErrorMissingPreimage = errors.New("Attribute value is a hash, but its preimage is missing")
+	// ErrorInvalidPreimage is returned when the preimage of an attribute does not match its hash.
+	ErrorInvalidPreimage = errors.New("Attribute value does not match the hash in the credential")
+)
+
+// AttributeSize returns the maximum length in bytes of attribute values that can be encoded
+// directly (i.e. without hashing) into credentials of the public key, given the metadata version.
+func AttributeSize(pk *gabi.PublicKey, metadataVersion byte) (int, error) {
+	if pk == nil || pk.N == nil {
+		return 0, errors.New("Public key unavailable, cannot determine attribute size")
+	}
+	params, ok := gabi.DefaultSystemParameters[pk.N.BitLen()]
+	if !ok {
+		return 0, errors.Errorf("Unsupported public key size %d", pk.N.BitLen())
+	}
+	bits := int(params.Lm)
+	switch {
+	case metadataVersion < 0x03:
+		return bits / 8, nil
+	case metadataVersion == 0x03:
+		return (bits - 1) / 8, nil
+	default:
+		return (bits - 2) / 8, nil
+	}
+}
+
+// encodeAttribute encodes the value into an attribute, returning whether or not it was hashed.
+// The size (see AttributeSize()) is only used from metadata version 0x04.
+func encodeAttribute(value string, metadataVersion byte, size int) (*big.Int, bool) {
+	switch {
+	case metadataVersion < 0x03:
+		return new(big.Int).SetBytes([]byte(value)), false
+	case metadataVersion == 0x03:
+		i := new(big.Int).SetBytes([]byte(value))
+		return i.Lsh(i, 1).SetBit(i, 0, 1), false
+	default:
+		if len(value) > size {
+			return hashAttribute(value), true
+		}
+		i := new(big.Int).SetBytes([]byte(value))
+		return i.Lsh(i, 2).SetBit(i, 0, 1), false
+	}
+}
+
+// hashAttribute returns the attribute that replaces a value too long to be encoded directly
+// from metadata version 0x04: the first 31 bytes of its SHA-256 hash, shifted left by two bits,
+// with the lowest two bits set.
+func hashAttribute(value string) *big.Int {
+	hash := sha256.Sum256([]byte(value))
+	i := new(big.Int).SetBytes(hash[:attributeHashLength])
+	return i.Lsh(i, 2).Or(i, big.NewInt(3))
+}
+
+// decodeAttribute decodes the attribute, returning nil if it is absent. If the attribute is the
+// hash of its value, the value must be passed as preimage, which is then checked against the hash.
+func decodeAttribute(attr *big.Int, metadataVersion byte, preimage *string) (*string, error) {
+	bi := new(big.Int).Set(attr)
+	switch {
+	case metadataVersion < 0x03: // nop
+	case bi.Bit(0) == 0: // attribute does not exist
+		return nil, nil
+	case metadataVersion == 0x03:
+		bi.Rsh(bi, 1)
+	case bi.Bit(1) == 1:
+		if preimage == nil {
+			return nil, ErrorMissingPreimage
+		}
+		if hashAttribute(*preimage).Cmp(attr) != 0 {
+			return nil, ErrorInvalidPreimage
+		}
+		return preimage, nil
+	default:
+		bi.Rsh(bi, 2)
+	}
+	str := string(bi.Bytes())
+	return &str, nil
+}
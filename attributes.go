@@ -64,9 +64,13 @@ type MetadataAttribute struct {
 type AttributeList struct {
 	*MetadataAttribute `json:"-"`
 	Ints               []*big.Int
-	strings            []TranslatedString
-	info               *CredentialInfo
-	h                  string
+	// Values of attributes that the credential contains as hash (see AttributeSize()),
+	// by index in the attributes excluding the metadata attribute
+	Preimages map[int]string `json:",omitempty"`
+
+	strings []TranslatedString
+	info    *CredentialInfo
+	h       string
 }
 
 // NewAttributeListFromInts initializes a new AttributeList from a list of bigints.
@@ -79,7 +83,7 @@ func NewAttributeListFromInts(ints []*big.Int, conf *Configuration) *AttributeLi
 
 func (al *AttributeList) Info() *CredentialInfo {
 	if al.info == nil {
-		al.info = NewCredentialInfo(al.Ints, al.Conf)
+		al.info = newCredentialInfo(al)
 	}
 	return al.info
 }
@@ -111,24 +115,27 @@ func (al *AttributeList) Strings() []TranslatedString {
 	return al.strings
 }
 
+// decode decodes the i-th attribute (excluding the metadata attribute), returning nil if it is
+// absent, or if it is a hash whose preimage is missing or invalid.
 func (al *AttributeList) decode(i int) *string {
-	bi := new(big.Int).Set(al.Ints[i+1])
-	if al.MetadataAttribute.Version() >= 3 {
-		if bi.Bit(0) == 0 { // attribute does not exist
-			return nil
-		}
-		bi.Rsh(bi, 1)
+	var preimage *string
+	if value, present := al.Preimages[i]; present {
+		preimage = &value
+	}
+	str, err := decodeAttribute(al.Ints[i+1], al.MetadataAttribute.Version(), preimage)
+	if err != nil {
+		return nil
 	}
-	str := string(bi.Bytes())
-	return &str
+	return str
 }
 
 // UntranslatedAttribute decodes the bigint corresponding to the specified attribute.
 func (al *AttributeList) UntranslatedAttribute(identifier AttributeTypeIdentifier) *string {
-	if al.CredentialType().Identifier() != identifier.CredentialTypeIdentifier() {
+	credtype := al.CredentialType()
+	if credtype == nil || credtype.Identifier() != identifier.CredentialTypeIdentifier() {
 		return nil
 	}
-	for i, desc := range al.CredentialType().Attributes {
+	for i, desc := range credtype.Attributes {
 		if desc.ID == string(identifier.Name()) {
 			return al.decode(i)
 		}
@@ -138,10 +145,11 @@ func (al *AttributeList) UntranslatedAttribute(identifier AttributeTypeIdentifie
 
 // Attribute returns the content of the specified attribute, or "" if not present in this attribute list.
 func (al *AttributeList) Attribute(identifier AttributeTypeIdentifier) TranslatedString {
-	if al.CredentialType().Identifier() != identifier.CredentialTypeIdentifier() {
+	credtype := al.CredentialType()
+	if credtype == nil || credtype.Identifier() != identifier.CredentialTypeIdentifier() {
 		return nil
 	}
-	for i, desc := range al.CredentialType().Attributes {
+	for i, desc := range credtype.Attributes {
 		if desc.ID == string(identifier.Name()) {
 			return al.Strings()[i]
 		}
@@ -149,6 +157,67 @@ func (al *AttributeList) Attribute(identifier AttributeTypeIdentifier) Translate
 	return nil
 }
 
+// IntegerAttribute returns the value of the specified integer attribute, or nil if it is absent.
+func (al *AttributeList) IntegerAttribute(identifier AttributeTypeIdentifier) (*big.Int, error) {
+	val, err := al.typedAttribute(identifier, AttributeValueInteger)
+	if val == nil || err != nil {
+		return nil, err
+	}
+	return val.(*big.Int), nil
+}
+
+// DateAttribute returns the value of the specified date attribute, or nil if it is absent.
+func (al *AttributeList) DateAttribute(identifier AttributeTypeIdentifier) (*time.Time, error) {
+	val, err := al.typedAttribute(identifier, AttributeValueDate)
+	if val == nil || err != nil {
+		return nil, err
+	}
+	date := val.(time.Time)
+	return &date, nil
+}
+
+// BooleanAttribute returns the value of the specified boolean attribute, or nil if it is absent.
+func (al *AttributeList) BooleanAttribute(identifier AttributeTypeIdentifier) (*bool, error) {
+	val, err := al.typedAttribute(identifier, AttributeValueBoolean)
+	if val == nil || err != nil {
+		return nil, err
+	}
+	b := val.(bool)
+	return &b, nil
+}
+
+// ImageAttribute returns the decoded contents of the specified image attribute,
+// or nil if it is absent.
+func (al *AttributeList) ImageAttribute(identifier AttributeTypeIdentifier) ([]byte, error) {
+	val, err := al.typedAttribute(identifier, AttributeValueImage)
+	if val == nil || err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
+
+// typedAttribute returns the parsed value of the specified attribute (see
+// AttributeDescription.ParseValue()), after checking that it is of the expected type.
+// It returns nil if the attribute is absent.
+func (al *AttributeList) typedAttribute(identifier AttributeTypeIdentifier, typ AttributeValueType) (interface{}, error) {
+	credtype := al.CredentialType()
+	if credtype == nil || credtype.Identifier() != identifier.CredentialTypeIdentifier() {
+		return nil, errors.Errorf("Attribute %s not contained in credential type", identifier)
+	}
+	desc := al.Conf.AttributeDescription(identifier)
+	if desc == nil {
+		return nil, errors.Errorf("Attribute %s not contained in credential type", identifier)
+	}
+	if desc.ValueType() != typ {
+		return nil, errors.Errorf("Attribute %s is of type %s, not %s", identifier, desc.ValueType(), typ)
+	}
+	val := al.UntranslatedAttribute(identifier)
+	if val == nil {
+		return nil, nil
+	}
+	return desc.ParseValue(*val)
+}
+
 // MetadataFromInt wraps the given Int
 func MetadataFromInt(i *big.Int, conf *Configuration) *MetadataAttribute {
 	return &MetadataAttribute{Int: i, Conf: conf}
@@ -379,7 +448,7 @@ func (disjunction *AttributeDisjunction) SatisfyDisclosed(disclosed DisclosedCre
 		requestedValue := disjunction.Values[attr]
 
 		var isSatisfied bool
-		isSatisfied, attributeResult = disclosed.isAttributeSatisfied(attr, requestedValue)
+		isSatisfied, attributeResult = disclosed.isAttributeSatisfied(attr, requestedValue, conf)
 
 		if isSatisfied {
 			return true, disjunction.ToDisclosedAttributeDisjunction(attributeResult)
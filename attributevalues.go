@@ -0,0 +1,186 @@
+package irma
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// AttributeValueType is the type of the values of an attribute, as specified by the type attribute
+// of its description in the credential type's description.xml. Attributes are issued as strings
+// regardless of their type; the type determines which strings are valid values and what they mean.
+type AttributeValueType string
+
+// Attribute value types
+const (
+	AttributeValueString  = AttributeValueType("string")  // Any string, the default
+	AttributeValueInteger = AttributeValueType("integer") // Decimal integer, e.g. "-12"
+	AttributeValueDate    = AttributeValueType("date")    // Date of the form YYYY-MM-DD
+	AttributeValueBoolean = AttributeValueType("boolean") // "true" or "false"
+	AttributeValueEnum    = AttributeValueType("enum")    // One of the values listed in the attribute description
+	AttributeValueImage   = AttributeValueType("image")   // Image, e.g. PNG or JPEG, in standard base64 encoding
+)
+
+// AttributeDateLayout is the layout (see time.Parse()) of the values of date attributes.
+const AttributeDateLayout = "2006-01-02"
+
+// InvalidAttributeValueError is returned when a value is invalid for the type of its attribute,
+// e.g. when issuing a credential containing it.
+type InvalidAttributeValueError struct {
+	Attribute string // ID of the attribute
+	Message   string
+}
+
+func (e *InvalidAttributeValueError) Error() string {
+	return fmt.Sprintf("Attribute %s: %s", e.Attribute, e.Message)
+}
+
+func (ad *AttributeDescription) invalidValue(format string, args ...interface{}) error {
+	return &InvalidAttributeValueError{Attribute: ad.ID, Message: fmt.Sprintf(format, args...)}
+}
+
+// ValueType returns the type of the values of the attribute. Attributes without type, or with
+// a type unknown to us (e.g. introduced in a later version of irmago), are treated as strings.
+func (ad *AttributeDescription) ValueType() AttributeValueType {
+	switch t := AttributeValueType(ad.Type); t {
+	case AttributeValueInteger, AttributeValueDate, AttributeValueBoolean, AttributeValueEnum, AttributeValueImage:
+		return t
+	default:
+		return AttributeValueString
+	}
+}
+
+// ParseValue parses the value according to the type of the attribute, returning respectively
+// a string, *big.Int, time.Time, bool, string or []byte, or an *InvalidAttributeValueError
+// if the value is invalid.
+func (ad *AttributeDescription) ParseValue(value string) (interface{}, error) {
+	switch ad.ValueType() {
+	case AttributeValueInteger:
+		i, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, ad.invalidValue("%q is not an integer", value)
+		}
+		return i, nil
+	case AttributeValueDate:
+		date, err := time.Parse(AttributeDateLayout, value)
+		if err != nil {
+			return nil, ad.invalidValue("%q is not a date of the form YYYY-MM-DD", value)
+		}
+		return date, nil
+	case AttributeValueBoolean:
+		switch value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		default:
+			return nil, ad.invalidValue("%q is not a boolean", value)
+		}
+	case AttributeValueEnum:
+		for _, allowed := range ad.Values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return nil, ad.invalidValue("%q is not one of the allowed values", value)
+	case AttributeValueImage:
+		bts, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, ad.invalidValue("value is not base64 encoded")
+		}
+		return bts, nil
+	default:
+		return value, nil
+	}
+}
+
+// ValidateValue returns an error if the value is invalid for the type of the attribute.
+func (ad *AttributeDescription) ValidateValue(value string) error {
+	_, err := ad.ParseValue(value)
+	return err
+}
+
+// EqualValues returns whether or not the two values of the attribute are equal according to
+// its type; e.g. the integers "7" and "007" are equal. Invalid values are compared as strings.
+func (ad *AttributeDescription) EqualValues(a, b string) bool {
+	if cmp, err := ad.CompareValues(a, b); err == nil {
+		return cmp == 0
+	}
+	return a == b // Other types have only one representation per value
+}
+
+// CompareValues returns -1, 0 or 1 if the value a is respectively below, equal to, or above b
+// according to the type of the attribute, e.g. "9" is below "10" for integers and "2017-12-31"
+// is below "2018-01-01" for dates. Only integer and date attributes are ordered; for other
+// attributes, and for invalid values, an error is returned.
+func (ad *AttributeDescription) CompareValues(a, b string) (int, error) {
+	switch ad.ValueType() {
+	case AttributeValueInteger, AttributeValueDate: // nop
+	default:
+		return 0, errors.Errorf("Values of attribute %s of type %s are not ordered", ad.ID, ad.ValueType())
+	}
+	x, err := ad.ParseValue(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := ad.ParseValue(b)
+	if err != nil {
+		return 0, err
+	}
+	if x, ok := x.(*big.Int); ok {
+		return x.Cmp(y.(*big.Int)), nil
+	}
+	switch dx, dy := x.(time.Time), y.(time.Time); {
+	case dx.Before(dy):
+		return -1, nil
+	case dx.After(dy):
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// AttributeDescription returns the description of the specified attribute,
+// or nil if it is not present in the configuration.
+func (conf *Configuration) AttributeDescription(id AttributeTypeIdentifier) *AttributeDescription {
+	credtype := conf.CredentialTypes[id.CredentialTypeIdentifier()]
+	if credtype == nil {
+		return nil
+	}
+	index, err := credtype.IndexOf(id)
+	if err != nil {
+		return nil
+	}
+	return &credtype.Attributes[index]
+}
+
+// AttributeValuesEqual returns whether or not the two values of the specified attribute are
+// equal according to its type (see AttributeDescription.EqualValues()). Values of attributes
+// that are not present in the configuration are compared as strings.
+func (conf *Configuration) AttributeValuesEqual(id AttributeTypeIdentifier, a, b string) bool {
+	if conf == nil {
+		return a == b
+	}
+	desc := conf.AttributeDescription(id)
+	if desc == nil {
+		return a == b
+	}
+	return desc.EqualValues(a, b)
+}
+
+// CompareAttributeValues compares the two values of the specified attribute according to its
+// type (see AttributeDescription.CompareValues()), returning an error if the attribute is not
+// present in the configuration or its values are not ordered.
+func (conf *Configuration) CompareAttributeValues(id AttributeTypeIdentifier, a, b string) (int, error) {
+	if conf == nil {
+		return 0, errors.Errorf("Attribute %s not present in configuration", id)
+	}
+	desc := conf.AttributeDescription(id)
+	if desc == nil {
+		return 0, errors.Errorf("Attribute %s not present in configuration", id)
+	}
+	return desc.CompareValues(a, b)
+}
@@ -24,13 +24,16 @@ type CredentialInfo struct {
 type CredentialInfoList []*CredentialInfo
 
 func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
-	meta := MetadataFromInt(ints[0], conf)
+	return newCredentialInfo(NewAttributeListFromInts(ints, conf))
+}
+
+func newCredentialInfo(attrs *AttributeList) *CredentialInfo {
+	meta := attrs.MetadataAttribute
 	credtype := meta.CredentialType()
 	if credtype == nil {
 		return nil
 	}
 
-	attrs := NewAttributeListFromInts(ints, conf)
 	id := credtype.Identifier()
 	issid := id.IssuerIdentifier()
 	return &CredentialInfo{
@@ -41,7 +44,7 @@ func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
 		SignedOn:         Timestamp(meta.SigningDate()),
 		Expires:          Timestamp(meta.Expiry()),
 		Attributes:       attrs.Strings(),
-		Logo:             credtype.Logo(conf),
+		Logo:             credtype.Logo(meta.Conf),
 		Hash:             attrs.Hash(),
 	}
 }
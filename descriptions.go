@@ -24,6 +24,11 @@ type SchemeManager struct {
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
 
+	// SPKI pins (see CertificatePin()) of the servers at URL and KeyshareServer; if present,
+	// we only accept these servers if one of their certificates matches one of the pins
+	URLPins      []string `xml:"UrlPins>Pin"`
+	KeysharePins []string `xml:"KeysharePins>Pin"`
+
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
@@ -78,8 +83,11 @@ func (ct *CredentialType) ContainsAttribute(ai AttributeTypeIdentifier) bool {
 type AttributeDescription struct {
 	ID          string `xml:"id,attr"`
 	Optional    string `xml:"optional,attr"`
+	Type        string `xml:"type,attr"` // See ValueType()
 	Name        TranslatedString
 	Description TranslatedString
+	// Allowed values of enum attributes
+	Values []string `xml:"Values>Value"`
 }
 
 func (ad AttributeDescription) GetAttributeTypeIdentifier(cred CredentialTypeIdentifier) AttributeTypeIdentifier {
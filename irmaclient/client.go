@@ -2,8 +2,10 @@ package irmaclient
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"math/big"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/credentials/go-go-gadget-paillier"
@@ -37,6 +39,12 @@ import (
 // - The secret key (the zeroth attribute of every credential), being the same
 // across all credentials, is stored only once in a separate file (storing this
 // in multiple places would be bad).
+//
+// A Client may be used by multiple IRMA sessions at the same time. Its exported methods
+// acquire its lock, while its unexported methods assume that the caller holds it.
+// The lock is never held while calling the ClientHandler, which may call us back.
+// Sessions download into or install scheme managers in the Configuration only while
+// holding the lock.
 
 type Client struct {
 	// Stuff we manage on disk
@@ -47,6 +55,7 @@ type Client struct {
 	paillierKeyCache *paillierPrivateKey
 	logs             []*LogEntry
 	updates          []update
+	policy           []*PolicyRule
 
 	// Where we store/load it to/from
 	storage storage
@@ -58,7 +67,21 @@ type Client struct {
 	irmaConfigurationPath    string
 	androidStoragePath       string
 	handler                  ClientHandler
-	state                    *issuanceState
+
+	// Protects the stuff we manage on disk, UnenrolledSchemeManagers and Preferences
+	lock sync.Mutex
+	// Protects paillierKeyCache, which is computed in the background
+	paillierKeyLock sync.Mutex
+
+	// Hashes of credentials of which the handler has been informed that they
+	// are expired (true) or about to expire (false)
+	expiryNotified map[string]bool
+	// Issuance state of IssuanceProofBuilders() for ConstructCredentials(); sessions keep their own
+	state *issuanceState
+
+	// Closed by Close() to stop the expiry monitor
+	expiryStop chan struct{}
+	closeOnce  sync.Once
 }
 
 // SentryDSN should be set in the init() function
@@ -66,11 +89,19 @@ type Client struct {
 var SentryDSN = ""
 
 type Preferences struct {
-	EnableCrashReporting bool
+	EnableCrashReporting     bool
+	ExpiryWarningDays        int  // Warn this many days in advance of the expiry of a credential
+	RemoveExpiredCredentials bool // Automatically remove credentials once they are expired
+	ExcludeExpiredCandidates bool // Don't offer expired credentials for disclosure
+	KeysharePinGracePeriod   int  // Seconds after entering the PIN during which it is not asked again (-1: as long as the keyshare server allows)
 }
 
 var defaultPreferences = Preferences{
-	EnableCrashReporting: true,
+	EnableCrashReporting:     true,
+	ExpiryWarningDays:        14,
+	RemoveExpiredCredentials: false,
+	ExcludeExpiredCandidates: true,
+	KeysharePinGracePeriod:   -1,
 }
 
 // KeyshareHandler is used for asking the user for his email address and PIN,
@@ -81,7 +112,7 @@ type KeyshareHandler interface {
 }
 
 // ClientHandler informs the user that the configuration or the list of attributes
-// that this client uses has been updated.
+// that this client uses has been updated. It may also implement ExpiryHandler and SecureStorage.
 type ClientHandler interface {
 	KeyshareHandler
 
@@ -101,7 +132,7 @@ type secretKey struct {
 // and handler is used for informing the user of new stuff, and when a
 // enrollment to a keyshare server needs to happen.
 // The client returned by this function has been fully deserialized
-// and is ready for use.
+// and is ready for use; Close() stops its background activities.
 //
 // NOTE: It is the responsibility of the caller that there exists a (properly
 // protected) directory at storagePath!
@@ -126,6 +157,7 @@ func New(
 		irmaConfigurationPath: irmaConfigurationPath,
 		androidStoragePath:    androidStoragePath,
 		handler:               handler,
+		expiryNotified:        make(map[string]bool),
 	}
 
 	cm.Configuration, err = irma.NewConfiguration(storagePath+"/irma_configuration", irmaConfigurationPath)
@@ -167,9 +199,16 @@ func New(
 	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
 		return nil, err
 	}
+	if err = cm.loadKeyshareTokens(); err != nil {
+		// Without the tokens we merely have to ask for the PIN again
+		cm.Configuration.Log(irma.LogLevelWarning, "keyshare.loadTokens", irma.LogFields{"error": err.Error()})
+	}
 	if cm.paillierKeyCache, err = cm.storage.LoadPaillierKeys(); err != nil {
 		return nil, err
 	}
+	if cm.policy, err = cm.storage.LoadPolicy(); err != nil {
+		return nil, err
+	}
 	if cm.paillierKeyCache == nil {
 		cm.paillierKey(false)
 	}
@@ -179,11 +218,23 @@ func New(
 		return nil, errors.New("Too many keyshare servers")
 	}
 
+	cm.startExpiryMonitor()
+
 	return cm, schemeMgrErr
 }
 
+// SetLogger sets the logger receiving the log events of this client, its sessions and its
+// Configuration. If nil, irma.DefaultLogger is used. It should be called before any sessions
+// are started; events of New() itself go to irma.DefaultLogger.
+func (client *Client) SetLogger(logger irma.Logger) {
+	client.Configuration.Logger = logger
+}
+
 // CredentialInfoList returns a list of information of all contained credentials.
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
 	for _, attrlistlist := range client.attributes {
@@ -294,20 +345,34 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 
 // RemoveCredential removes the specified credential.
 func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index int) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	return client.remove(id, index, true)
 }
 
 // RemoveCredentialByHash removes the specified credential.
 func (client *Client) RemoveCredentialByHash(hash string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.removeByHash(hash)
+}
+
+func (client *Client) removeByHash(hash string) error {
 	cred, index, err := client.credentialByHash(hash)
 	if err != nil {
 		return err
 	}
-	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
+	if cred == nil {
+		return errors.Errorf("Can't remove credential with hash %s: no such credential", hash)
+	}
+	return client.remove(cred.CredentialType().Identifier(), index, true)
 }
 
 // RemoveAllCredentials removes all credentials.
 func (client *Client) RemoveAllCredentials() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 	for _, attrlistlist := range client.attributes {
 		for _, attrs := range attrlistlist {
@@ -357,6 +422,12 @@ func (client *Client) creds(id irma.CredentialTypeIdentifier) map[int]*credentia
 
 // Attributes returns the attribute list of the requested credential, or nil if we do not have it.
 func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.attributeList(id, counter)
+}
+
+func (client *Client) attributeList(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
 	list := client.attrs(id)
 	if len(list) <= counter {
 		return
@@ -394,7 +465,7 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 	// deserialized during New(). If so, there should be a corresponding signature file,
 	// so we read that, construct the credential, and add it to the credential map
 	if _, exists := client.creds(id)[counter]; !exists {
-		attrs := client.Attributes(id, counter)
+		attrs := client.attributeList(id, counter)
 		if attrs == nil { // We do not have the requested cred
 			return
 		}
@@ -430,9 +501,23 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 // Methods used in the IRMA protocol
 
 // Candidates returns a list of attributes present in this client
-// that satisfy the specified attribute disjunction.
+// that satisfy the specified attribute disjunction. The candidates are ranked from most
+// to least preferable: attributes from non-expired credentials come first, and
+// attributes from more recently issued credentials come before older ones.
 func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
-	candidates := make([]*irma.AttributeIdentifier, 0, 10)
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.candidates(disjunction, true)
+}
+
+// candidates computes the candidates of the disjunction (see Candidates()), leaving out attributes
+// that our credentials contain as hash if hashes is false.
+func (client *Client) candidates(disjunction *irma.AttributeDisjunction, hashes bool) []*irma.AttributeIdentifier {
+	type candidate struct {
+		id    *irma.AttributeIdentifier
+		attrs *irma.AttributeList
+	}
+	found := make([]candidate, 0, 10)
 
 	for _, attribute := range disjunction.Attributes {
 		credID := attribute.CredentialTypeIdentifier()
@@ -445,40 +530,133 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 			continue
 		}
 		for _, attrs := range creds {
+			if client.Preferences.ExcludeExpiredCandidates && !attrs.IsValid() {
+				continue
+			}
 			id := &irma.AttributeIdentifier{Type: attribute, CredentialHash: attrs.Hash()}
 			if attribute.IsCredential() {
-				candidates = append(candidates, id)
+				found = append(found, candidate{id, attrs})
 			} else {
 				val := attrs.UntranslatedAttribute(attribute)
-				if val == nil {
+				if val == nil || (!hashes && containsHash(attrs, attribute)) {
 					continue
 				}
 				if !disjunction.HasValues() {
-					candidates = append(candidates, id)
+					found = append(found, candidate{id, attrs})
 				} else {
 					requiredValue, present := disjunction.Values[attribute]
-					if !present || requiredValue == nil || *val == *requiredValue {
-						candidates = append(candidates, id)
+					if !present || requiredValue == nil ||
+						client.Configuration.AttributeValuesEqual(attribute, *val, *requiredValue) {
+						found = append(found, candidate{id, attrs})
 					}
 				}
 			}
 		}
 	}
 
+	sort.SliceStable(found, func(i, j int) bool {
+		ivalid, jvalid := found[i].attrs.IsValid(), found[j].attrs.IsValid()
+		if ivalid != jvalid {
+			return ivalid
+		}
+		return found[i].attrs.SigningDate().After(found[j].attrs.SigningDate())
+	})
+
+	candidates := make([]*irma.AttributeIdentifier, 0, len(found))
+	for _, c := range found {
+		candidates = append(candidates, c.id)
+	}
 	return candidates
 }
 
+// DefaultChoice returns the most preferable choice of attributes to disclose in the
+// specified session request, or an error if we cannot satisfy it. Per disjunction one of the
+// highest ranked candidates (see Candidates()) is chosen; if several candidates are equally
+// valid and recent, attributes are taken from as few distinct credentials as possible,
+// as each of those requires a disclosure proof.
+func (client *Client) DefaultChoice(request irma.IrmaSession) (*irma.DisclosureChoice, error) {
+	candidates, missing := client.checkSatisfiability(request.ToDisclose(), preimagesSupported(request))
+	if len(missing) > 0 {
+		return nil, errors.Errorf("Request is not satisfiable: missing %d attribute(s)", len(missing))
+	}
+
+	client.lock.Lock()
+	lists := map[string]*irma.AttributeList{}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			lists[attrs.Hash()] = attrs
+		}
+	}
+	client.lock.Unlock()
+
+	return chooseCandidates(candidates, func(a, b *irma.AttributeIdentifier) bool {
+		x, y := lists[a.CredentialHash], lists[b.CredentialHash]
+		if x == nil || y == nil { // removed in the meantime
+			return false
+		}
+		return x.IsValid() == y.IsValid() && x.SigningDate().Equal(y.SigningDate())
+	}), nil
+}
+
+// chooseCandidates chooses an attribute from each of the candidate lists, each of which is
+// sorted from high to low rank. Of the candidates ranked equal to the first one, it prefers
+// one from a credential that is already chosen, and otherwise one from the credential that
+// can satisfy the most candidate lists.
+func chooseCandidates(
+	candidates [][]*irma.AttributeIdentifier, equallyRanked func(a, b *irma.AttributeIdentifier) bool,
+) *irma.DisclosureChoice {
+	// Count for each credential how many disjunctions it can satisfy
+	coverage := map[string]int{}
+	for _, list := range candidates {
+		seen := map[string]bool{}
+		for _, attr := range list {
+			if !seen[attr.CredentialHash] {
+				seen[attr.CredentialHash] = true
+				coverage[attr.CredentialHash]++
+			}
+		}
+	}
+
+	chosen := map[string]bool{}
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	for _, list := range candidates {
+		best := list[0]
+		for _, attr := range list[1:] {
+			if chosen[best.CredentialHash] || !equallyRanked(list[0], attr) {
+				break
+			}
+			if chosen[attr.CredentialHash] || coverage[attr.CredentialHash] > coverage[best.CredentialHash] {
+				best = attr
+			}
+		}
+		chosen[best.CredentialHash] = true
+		choice.Attributes = append(choice.Attributes, best)
+	}
+	return choice
+}
+
 // CheckSatisfiability checks if this client has the required attributes
 // to satisfy the specifed disjunction list. If not, the unsatisfiable disjunctions
 // are returned.
 func (client *Client) CheckSatisfiability(
 	disjunctions irma.AttributeDisjunctionList,
 ) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
+	return client.checkSatisfiability(disjunctions, true)
+}
+
+// checkSatisfiability is CheckSatisfiability(), leaving out candidates that our credentials
+// contain as hash if hashes is false.
+func (client *Client) checkSatisfiability(
+	disjunctions irma.AttributeDisjunctionList, hashes bool,
+) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	candidates := [][]*irma.AttributeIdentifier{}
 	missing := irma.AttributeDisjunctionList{}
 	for i, disjunction := range disjunctions {
 		candidates = append(candidates, []*irma.AttributeIdentifier{})
-		candidates[i] = client.Candidates(disjunction)
+		candidates[i] = client.candidates(disjunction, hashes)
 		if len(candidates[i]) == 0 {
 			missing = append(missing, disjunction)
 		}
@@ -522,6 +700,12 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (map[irma.
 
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice) (gabi.ProofBuilderList, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.proofBuilders(choice)
+}
+
+func (client *Client) proofBuilders(choice *irma.DisclosureChoice) (gabi.ProofBuilderList, error) {
 	todisclose, err := client.groupCredentials(choice)
 	if err != nil {
 		return nil, err
@@ -547,21 +731,79 @@ func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.IrmaSes
 	return builders.BuildProofList(request.GetContext(), request.GetNonce(), issig), nil
 }
 
-// IssuanceProofBuilders constructs a list of proof builders in the issuance protocol
-// for the future credentials as well as possibly any disclosed attributes.
-func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi.ProofBuilderList, error) {
+// preimages returns the values of the attributes in the disclosure choice that our credentials
+// contain as hash (see irma.AttributeSize()), which the verifier needs along with our proofs.
+// The caller must hold the lock.
+func (client *Client) preimages(choice *irma.DisclosureChoice) map[irma.AttributeTypeIdentifier]string {
+	preimages := map[irma.AttributeTypeIdentifier]string{}
+	if choice == nil {
+		return preimages
+	}
+	for _, attribute := range choice.Attributes {
+		if attribute.Type.IsCredential() {
+			continue
+		}
+		for _, attrs := range client.attrs(attribute.Type.CredentialTypeIdentifier()) {
+			if attrs.Hash() != attribute.CredentialHash || len(attrs.Preimages) == 0 {
+				continue
+			}
+			index, err := attrs.CredentialType().IndexOf(attribute.Type)
+			if err != nil {
+				continue
+			}
+			if value, present := attrs.Preimages[index]; present {
+				preimages[attribute.Type] = value
+			}
+		}
+	}
+	return preimages
+}
+
+// containsHash returns whether or not the attribute list contains the attribute as hash
+// (see irma.AttributeSize()).
+func containsHash(attrs *irma.AttributeList, attribute irma.AttributeTypeIdentifier) bool {
+	if len(attrs.Preimages) == 0 {
+		return false
+	}
+	index, err := attrs.CredentialType().IndexOf(attribute)
+	if err != nil {
+		return false
+	}
+	_, present := attrs.Preimages[index]
+	return present
+}
+
+// preimagesSupported returns whether or not our response to the session request can carry the
+// values of disclosed attributes that our credentials contain as hash, without which the verifier
+// cannot interpret those attributes. Only the ProofsMessage of disclosure and signature sessions
+// carries them.
+func preimagesSupported(request irma.IrmaSession) bool {
+	if _, issuance := request.(*irma.IssuanceRequest); issuance {
+		return false
+	}
+	return request.GetVersion().Features().ProofsMessage
+}
+
+// issuanceProofBuilders constructs a list of proof builders in the issuance protocol
+// for the future credentials as well as possibly any disclosed attributes, along with
+// the state that is needed to construct the credentials once the issuer has signed them.
+func (client *Client) issuanceProofBuilders(request *irma.IssuanceRequest) (
+	gabi.ProofBuilderList, *issuanceState, error,
+) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	state, err := newIssuanceState()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	client.state = state
 
 	proofBuilders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, futurecred := range request.Credentials {
 		var pk *gabi.PublicKey
 		pk, err = client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		credBuilder := gabi.NewCredentialBuilder(
 			pk, request.GetContext(), client.secretkey.Key, state.nonce2)
@@ -569,52 +811,106 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi
 		proofBuilders = append(proofBuilders, credBuilder)
 	}
 
-	disclosures, err := client.ProofBuilders(request.Choice)
+	disclosures, err := client.proofBuilders(request.Choice)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	proofBuilders = append(disclosures, proofBuilders...)
-	return proofBuilders, nil
+	return proofBuilders, state, nil
+}
+
+// IssuanceProofBuilders constructs a list of proof builders in the issuance protocol
+// for the future credentials as well as possibly any disclosed attributes.
+// The issuance state is kept in the client for ConstructCredentials(), so that only one
+// issuance at a time can be performed using these functions (IRMA sessions are not affected).
+func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi.ProofBuilderList, error) {
+	builders, state, err := client.issuanceProofBuilders(request)
+	if err != nil {
+		return nil, err
+	}
+	client.lock.Lock()
+	client.state = state
+	client.lock.Unlock()
+	return builders, nil
+}
+
+// issueCommitments computes issuance commitments, along with disclosure proofs
+// specified by choice, and the state with which the credentials are to be constructed.
+func (client *Client) issueCommitments(request *irma.IssuanceRequest) (
+	*gabi.IssueCommitmentMessage, *issuanceState, error,
+) {
+	proofBuilders, state, err := client.issuanceProofBuilders(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	list := proofBuilders.BuildProofList(request.GetContext(), request.GetNonce(), false)
+	return &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: state.nonce2}, state, nil
 }
 
 // IssueCommitments computes issuance commitments, along with disclosure proofs
-// specified by choice.
+// specified by choice. Like IssuanceProofBuilders() it keeps the issuance state in the client.
 func (client *Client) IssueCommitments(request *irma.IssuanceRequest) (*gabi.IssueCommitmentMessage, error) {
-	proofBuilders, err := client.IssuanceProofBuilders(request)
+	msg, state, err := client.issueCommitments(request)
 	if err != nil {
 		return nil, err
 	}
-	list := proofBuilders.BuildProofList(request.GetContext(), request.GetNonce(), false)
-	return &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: client.state.nonce2}, nil
+	client.lock.Lock()
+	client.state = state
+	client.lock.Unlock()
+	return msg, nil
 }
 
-// ConstructCredentials constructs and saves new credentials
-// using the specified issuance signature messages.
+// ConstructCredentials constructs and saves new credentials using the specified issuance
+// signature messages, and the issuance state from IssuanceProofBuilders() or IssueCommitments().
 func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest) error {
-	if len(msg) != len(client.state.builders) {
+	client.lock.Lock()
+	state := client.state
+	client.lock.Unlock()
+	if state == nil {
+		return errors.New("No issuance in progress")
+	}
+	return client.constructCredentials(msg, request, state)
+}
+
+// constructCredentials constructs and saves new credentials using the specified
+// issuance signature messages, and the state from issuanceProofBuilders().
+func (client *Client) constructCredentials(
+	msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, state *issuanceState,
+) error {
+	if len(msg) != len(state.builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
 
 	// First collect all credentials in a slice, so that if one of them induces an error,
 	// we save none of them to fail the session cleanly
 	gabicreds := []*gabi.Credential{}
+	preimages := []map[int]string{}
 	for i, sig := range msg {
-		attrs, err := request.Credentials[i].AttributeList(client.Configuration, getMetadataVersion(request.GetVersion()))
+		attrs, err := request.Credentials[i].AttributeList(client.Configuration, request.GetVersion().Features().MetadataVersion)
 		if err != nil {
 			return err
 		}
-		cred, err := client.state.builders[i].ConstructCredential(sig, attrs.Ints)
+		cred, err := state.builders[i].ConstructCredential(sig, attrs.Ints)
 		if err != nil {
 			return err
 		}
+		// The credential is bound to the part of our secret key held by the keyshare server
+		if i < len(state.commitments) && state.commitments[i] != nil && cred.Signature.KeyshareP == nil {
+			cred.Signature.KeyshareP = state.commitments[i].P
+		}
 		gabicreds = append(gabicreds, cred)
+		preimages = append(preimages, attrs.Preimages)
 	}
 
-	for _, gabicred := range gabicreds {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for i, gabicred := range gabicreds {
 		newcred, err := newCredential(gabicred, client.Configuration)
 		if err != nil {
 			return err
 		}
+		// The values of attributes that the credential contains as hash are stored along with it
+		newcred.AttributeList().Preimages = preimages[i]
 		if err = client.addCredential(newcred, true); err != nil {
 			return err
 		}
@@ -627,7 +923,9 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 
 // PaillierKey returns a new Paillier key (and generates a new one in a goroutine).
 func (client *Client) paillierKey(wait bool) *paillierPrivateKey {
+	client.paillierKeyLock.Lock()
 	cached := client.paillierKeyCache
+	client.paillierKeyLock.Unlock()
 	ch := make(chan bool)
 
 	// Would just write client.paillierKeyCache instead of cached here, but the worker
@@ -639,13 +937,18 @@ func (client *Client) paillierKey(wait bool) *paillierPrivateKey {
 		// generate yet another one for future calls, but no need to wait now
 		go client.paillierKeyWorker(false, ch)
 	}
+
+	client.paillierKeyLock.Lock()
+	defer client.paillierKeyLock.Unlock()
 	return client.paillierKeyCache
 }
 
 func (client *Client) paillierKeyWorker(wait bool, ch chan bool) {
 	newkey, _ := paillier.GenerateKey(rand.Reader, 2048)
+	client.paillierKeyLock.Lock()
 	client.paillierKeyCache = (*paillierPrivateKey)(newkey)
 	client.storage.StorePaillierKeys(client.paillierKeyCache)
+	client.paillierKeyLock.Unlock()
 	if wait {
 		ch <- true
 	}
@@ -663,6 +966,33 @@ func (client *Client) unenrolledSchemeManagers() []irma.SchemeManagerIdentifier
 
 // KeyshareEnroll attempts to enroll at the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email, pin string) {
+	client.keyshareEnroll(manager, email, pin, nil)
+}
+
+// KeyshareReenroll attempts to enroll again at the keyshare server of the specified scheme
+// manager, e.g. after our account there has been removed using KeyshareUnenroll(), or when
+// the keyshare server reports that our enrollment is incomplete (see
+// Handler.KeyshareEnrollmentIncomplete()). If we are still registered at the keyshare server
+// locally, we only enroll again if the keyshare server reports that it does not know that
+// registration (USER_NOT_REGISTERED), using the Paillier key pair of that registration again.
+// In any case our own secret key is kept, so that our credentials of other scheme managers
+// remain valid.
+func (client *Client) KeyshareReenroll(manager irma.SchemeManagerIdentifier, email, pin string) {
+	client.lock.Lock()
+	kss, ok := client.keyshareServers[manager]
+	if ok {
+		kss = kss.copy()
+	}
+	client.lock.Unlock()
+	client.keyshareEnroll(manager, email, pin, kss)
+}
+
+// keyshareEnroll enrolls at the keyshare server in the background, informing the handler of the
+// outcome. If previous is not nil we enroll using its Paillier key, if the keyshare server no
+// longer knows that registration; otherwise we use a new key.
+func (client *Client) keyshareEnroll(
+	manager irma.SchemeManagerIdentifier, email, pin string, previous *keyshareServer,
+) {
 	go func() {
 		defer func() {
 			if e := recover(); e != nil {
@@ -672,8 +1002,18 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 			}
 		}()
 
-		err := client.keyshareEnrollWorker(manager, email, pin)
+		var key *paillierPrivateKey
+		var err error
+		if previous != nil {
+			key = previous.PrivateKey
+			err = client.checkKeyshareUnregistered(previous)
+		}
+		if err == nil {
+			err = client.keyshareEnrollWorker(manager, email, pin, key)
+		}
+		client.lock.Lock()
 		client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
+		client.lock.Unlock()
 		if err != nil {
 			client.handler.EnrollmentError(manager, err)
 		} else {
@@ -683,7 +1023,24 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 
 }
 
-func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, email, pin string) error {
+// checkKeyshareUnregistered returns nil if the keyshare server reports that it does not know
+// the registration (USER_NOT_REGISTERED), so that we can enroll again, and an error otherwise.
+func (client *Client) checkKeyshareUnregistered(kss *keyshareServer) error {
+	transport := newKeyshareTransport(client.Configuration, kss.SchemeManagerIdentifier, kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	err := transport.Post("users/isAuthorized", &keyshareAuthorization{}, nil)
+	if userNotRegistered(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("Still enrolled at keyshare server of scheme manager, unenroll first")
+}
+
+func (client *Client) keyshareEnrollWorker(
+	managerID irma.SchemeManagerIdentifier, email, pin string, key *paillierPrivateKey,
+) error {
 	manager, ok := client.Configuration.SchemeManagers[managerID]
 	if !ok {
 		return errors.New("Unknown scheme manager")
@@ -695,8 +1052,11 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return errors.New("PIN too short, must be at least 5 characters")
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer)
-	kss, err := newKeyshareServer(managerID, client.paillierKey(true), manager.KeyshareServer, email)
+	if key == nil {
+		key = client.paillierKey(true)
+	}
+	transport := newKeyshareTransport(client.Configuration, managerID, manager.KeyshareServer)
+	kss, err := newKeyshareServer(managerID, key, manager.KeyshareServer, email)
 	if err != nil {
 		return err
 	}
@@ -711,25 +1071,162 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if err != nil {
 		return err
 	}
+	client.Configuration.Log(irma.LogLevelInfo, "keyshare.enroll", irma.LogFields{"scheme": managerID.String()})
 
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	client.keyshareServers[managerID] = kss
-	return client.storage.StoreKeyshareServers(client.keyshareServers)
+	return client.storeKeyshareServers()
+}
+
+// KeyshareChangePin changes our PIN at the keyshare server of the specified scheme manager.
+// Its return values have the same meaning as those of keyshareSession.verifyPinAttempt():
+// - If the old PIN is incorrect but there are attempts remaining, the amount of remaining
+// attempts is returned as the second return value.
+// - If the old PIN is incorrect and there are no attempts remaining, the amount of time for
+// which we are blocked at the keyshare server is returned as the third return value.
+// - If this or anything else (specified in err) goes wrong, success will be false.
+func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, oldPin, newPin string) (
+	success bool, tries int, blocked int, err error) {
+	if len(newPin) < 5 {
+		err = errors.New("PIN too short, must be at least 5 characters")
+		return
+	}
+	client.lock.Lock()
+	kss, ok := client.keyshareServers[manager]
+	client.lock.Unlock()
+	if !ok {
+		err = errors.New("Not enrolled at keyshare server of scheme manager")
+		return
+	}
+
+	transport := newKeyshareTransport(client.Configuration, manager, kss.URL)
+	message := keyshareChangePin{
+		Username: kss.Username,
+		OldPin:   kss.HashedPin(oldPin),
+		NewPin:   kss.HashedPin(newPin),
+	}
+	result := &keysharePinStatus{}
+	if err = transport.Post("users/change/pin", result, message); err != nil {
+		return
+	}
+
+	success, tries, blocked, err = result.parse()
+	if err == nil {
+		client.Configuration.Log(irma.LogLevelInfo, "keyshare.changePin", irma.LogFields{
+			"scheme": manager.String(), "success": success, "tries": tries, "blocked": blocked,
+		})
+	}
+	if !success {
+		return
+	}
+
+	// Authorization tokens obtained with the old PIN are no longer of use
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	kss.setToken("")
+	err = client.storeKeyshareServers()
+	success = err == nil
+	return
+}
+
+// KeyshareUnenroll removes our account at the keyshare server of the specified scheme manager,
+// after which it removes our local registration of the keyshare server like KeyshareRemove().
+// Credentials of the scheme manager can no longer be used afterwards. Our PIN is required to
+// authorize the removal; the return values have the same meaning as those of KeyshareChangePin().
+// If the keyshare server reports that it does not know us (USER_NOT_REGISTERED), we are
+// already unenrolled there, so only our local registration is removed.
+func (client *Client) KeyshareUnenroll(manager irma.SchemeManagerIdentifier, pin string) (
+	success bool, tries int, blocked int, err error) {
+	client.lock.Lock()
+	kss, ok := client.keyshareServers[manager]
+	if ok {
+		kss = kss.copy() // verifyPin() sets the token, which we won't need
+	}
+	client.lock.Unlock()
+	if !ok {
+		err = errors.New("Not enrolled at keyshare server of scheme manager")
+		return
+	}
+
+	// If the keyshare server does not know us, we are already unenrolled there
+	transport := newKeyshareTransport(client.Configuration, manager, kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	success, tries, blocked, err = kss.verifyPin(transport, pin)
+	if !success && !userNotRegistered(err) {
+		return
+	}
+	if success {
+		success = false
+		var response string // The server responds with no or an empty body
+		err = transport.Post("users/unregister", &response, nil)
+	}
+	if err != nil && !userNotRegistered(err) {
+		return
+	}
+	client.Configuration.Log(irma.LogLevelInfo, "keyshare.unenroll", irma.LogFields{
+		"scheme": manager.String(), "alreadyUnenrolled": err != nil,
+	})
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	delete(client.keyshareServers, manager)
+	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
+	err = client.storeKeyshareServers()
+	success = err == nil
+	return
+}
+
+// sessionKeyshareServers returns copies of our keyshare server registrations for use in
+// the keyshare protocol of a session, without the authorization tokens that may not be used
+// according to our PIN grace period preference. The caller must not hold the lock.
+func (client *Client) sessionKeyshareServers() map[irma.SchemeManagerIdentifier]*keyshareServer {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	keyshareServers := make(map[irma.SchemeManagerIdentifier]*keyshareServer, len(client.keyshareServers))
+	for id, kss := range client.keyshareServers {
+		keyshareServers[id] = kss.copy()
+		if !kss.tokenUsable(client.Preferences.KeysharePinGracePeriod) {
+			keyshareServers[id].setToken("")
+		}
+	}
+	return keyshareServers
+}
+
+// storeKeyshareTokens saves the authorization tokens from the specified keyshare server
+// registrations, as returned by sessionKeyshareServers() and used in the keyshare protocol,
+// so that the PIN is not asked again in later sessions. The caller must not hold the lock.
+func (client *Client) storeKeyshareTokens(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for id, used := range keyshareServers {
+		kss, ok := client.keyshareServers[id]
+		if !ok || kss.Username != used.Username || used.Token == "" {
+			continue // Meanwhile removed or reenrolled
+		}
+		kss.Token, kss.TokenTime, kss.TokenExpiry = used.Token, used.TokenTime, used.TokenExpiry
+	}
+	return client.storeKeyshareServers()
 }
 
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	if _, contains := client.keyshareServers[manager]; !contains {
 		return errors.New("Can't uninstall unknown keyshare server")
 	}
 	delete(client.keyshareServers, manager)
-	return client.storage.StoreKeyshareServers(client.keyshareServers)
+	return client.storeKeyshareServers()
 }
 
 // KeyshareRemoveAll removes all keyshare server registrations.
 func (client *Client) KeyshareRemoveAll() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
 	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
-	return client.storage.StoreKeyshareServers(client.keyshareServers)
+	return client.storeKeyshareServers()
 }
 
 // Add, load and store log entries
@@ -741,6 +1238,8 @@ func (client *Client) addLogEntry(entry *LogEntry) error {
 
 // Logs returns the log entries of past events.
 func (client *Client) Logs() ([]*LogEntry, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	if client.logs == nil || len(client.logs) == 0 {
 		var err error
 		client.logs, err = client.storage.LoadLogs()
@@ -748,17 +1247,44 @@ func (client *Client) Logs() ([]*LogEntry, error) {
 			return nil, err
 		}
 	}
-	return client.logs, nil
+	// Return a copy, so that the caller can iterate over it while new entries are added
+	return append([]*LogEntry{}, client.logs...), nil
+}
+
+// VerifyLoggedSignature verifies the attribute-based signature contained in the specified
+// log entry of a past signature session against our Configuration.
+func (client *Client) VerifyLoggedSignature(entry *LogEntry) (*irma.SignatureProofResult, error) {
+	signature, err := entry.Signature()
+	if err != nil {
+		return nil, err
+	}
+	proofs, err := json.Marshal(signature.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return irma.VerifySigWithPreimages(client.Configuration, string(proofs), signature.Request, signature.Preimages), nil
 }
 
 // SetCrashReportingPreference toggles whether or not crash reports should be sent to Sentry.
 // Has effect only after restarting.
 func (client *Client) SetCrashReportingPreference(enable bool) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	client.Preferences.EnableCrashReporting = enable
 	_ = client.storage.StorePreferences(client.Preferences)
 	client.applyPreferences()
 }
 
+// SetKeysharePinGracePeriodPreference sets the amount of seconds after entering the PIN during
+// which it is not asked again. The keyshare server may require the PIN sooner; if seconds is
+// negative, it is only asked when the keyshare server requires it.
+func (client *Client) SetKeysharePinGracePeriodPreference(seconds int) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.Preferences.KeysharePinGracePeriod = seconds
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
 func (client *Client) applyPreferences() {
 	if client.Preferences.EnableCrashReporting {
 		raven.SetDSN(SentryDSN)
@@ -0,0 +1,363 @@
+package irmaclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains an alternative to the Handler interface for following and
+// controlling IRMA sessions: StartSession() returns a channel on which everything
+// that happens in the session arrives as a typed SessionEvent, along with a
+// SessionController with which permission requests and PIN requests are answered.
+// NewSession() is implemented on top of this, dispatching the events to a Handler.
+
+// SessionEvent is an event that occurs during an IRMA session. It is one of the
+// *Event types from this file.
+type SessionEvent interface {
+	sessionEvent()
+}
+
+// StatusEvent informs of a new status of the session.
+type StatusEvent struct {
+	Action irma.Action
+	Status irma.Status
+}
+
+// SuccessEvent informs that the session completed successfully. It is the last event of the session.
+type SuccessEvent struct {
+	Action irma.Action
+	Result string
+}
+
+// CancelledEvent informs that the session was cancelled. It is the last event of the session.
+type CancelledEvent struct {
+	Action irma.Action
+}
+
+// FailureEvent informs that the session failed. It is the last event of the session.
+type FailureEvent struct {
+	Action irma.Action
+	Err    *irma.SessionError
+}
+
+// UnsatisfiableEvent informs that we lack the attributes that the session requests.
+// It is the last event of the session.
+type UnsatisfiableEvent struct {
+	Action     irma.Action
+	ServerName string
+	Missing    irma.AttributeDisjunctionList
+}
+
+// KeyshareBlockedEvent informs that the keyshare server of the scheme manager has blocked us
+// for the specified amount of seconds, due to too many wrong PIN attempts. It is the last event of the session.
+type KeyshareBlockedEvent struct {
+	Manager  irma.SchemeManagerIdentifier
+	Duration int
+}
+
+// KeyshareEnrollmentIncompleteEvent informs that our enrollment at the keyshare server
+// of the scheme manager has not been completed. It is the last event of the session.
+type KeyshareEnrollmentIncompleteEvent struct {
+	Manager irma.SchemeManagerIdentifier
+}
+
+// KeyshareEnrollmentMissingEvent informs that the session involves a scheme manager
+// at whose keyshare server we are not enrolled. It is the last event of the session.
+type KeyshareEnrollmentMissingEvent struct {
+	Manager irma.SchemeManagerIdentifier
+}
+
+// PermissionEvent asks permission to perform the session. Request is an *irma.DisclosureRequest,
+// *irma.SignatureRequest or *irma.IssuanceRequest, depending on Action. It must be answered
+// using SessionController.Permission().
+type PermissionEvent struct {
+	Action     irma.Action
+	ServerName string
+	Request    irma.IrmaSession
+}
+
+// SchemeManagerPermissionEvent asks permission to install a new scheme manager.
+// It must be answered using SessionController.SchemeManagerPermission().
+type SchemeManagerPermissionEvent struct {
+	Manager *irma.SchemeManager
+}
+
+// PinEvent asks for the user's PIN. It must be answered using SessionController.Pin().
+type PinEvent struct {
+	RemainingAttempts int
+}
+
+func (StatusEvent) sessionEvent()                       {}
+func (SuccessEvent) sessionEvent()                      {}
+func (CancelledEvent) sessionEvent()                    {}
+func (FailureEvent) sessionEvent()                      {}
+func (UnsatisfiableEvent) sessionEvent()                {}
+func (KeyshareBlockedEvent) sessionEvent()              {}
+func (KeyshareEnrollmentIncompleteEvent) sessionEvent() {}
+func (KeyshareEnrollmentMissingEvent) sessionEvent()    {}
+func (PermissionEvent) sessionEvent()                   {}
+func (SchemeManagerPermissionEvent) sessionEvent()      {}
+func (PinEvent) sessionEvent()                          {}
+
+// SessionController answers the requests that are sent as events during an IRMA session,
+// and can dismiss the session. Each method returns an error if there is no such
+// request to be answered.
+type SessionController interface {
+	SessionDismisser
+	Permission(proceed bool, choice *irma.DisclosureChoice) error
+	SchemeManagerPermission(proceed bool) error
+	Pin(proceed bool, pin string) error
+}
+
+// eventHandler is a Handler that sends everything that happens in the session on its
+// events channel, and a SessionController that answers the requests from the session.
+type eventHandler struct {
+	events    chan SessionEvent
+	dismisser SessionDismisser // Set before the session starts
+
+	// Events are queued by the session and delivered on events by forward(),
+	// so that the session is never blocked on the receiver of the events
+	sendLock sync.Mutex // Protects queue and last
+	queue    []SessionEvent
+	last     bool // Whether the last event has been queued
+	queued   chan struct{}
+
+	lock                    sync.Mutex // Protects the callbacks below
+	permission              PermissionHandler
+	schemeManagerPermission func(proceed bool)
+	pin                     PinHandler
+}
+
+var _ Handler = (*eventHandler)(nil)
+var _ SessionController = (*eventHandler)(nil)
+
+// StartSession creates and starts a new interactive IRMA session, returning a channel on
+// which the events of the session arrive and a controller with which to answer requests
+// from the session. The channel is closed after the last event of the session: a SuccessEvent,
+// CancelledEvent, FailureEvent, UnsatisfiableEvent or one of the keyshare events. In the latter
+// cases the session should be dismissed using the controller. The caller must keep receiving
+// from the channel until it is closed.
+func (client *Client) StartSession(qr *irma.Qr) (<-chan SessionEvent, SessionController) {
+	return client.StartSessionContext(context.Background(), qr)
+}
+
+// StartSessionContext is like StartSession(), but aborts the session when the specified
+// context is done (see NewSessionContext()).
+func (client *Client) StartSessionContext(ctx context.Context, qr *irma.Qr) (<-chan SessionEvent, SessionController) {
+	return client.StartSessionTransport(ctx, qr, nil)
+}
+
+// StartSessionTransport is like StartSessionContext(), but runs the session over the
+// specified transport (see NewSessionTransport()).
+func (client *Client) StartSessionTransport(
+	ctx context.Context, qr *irma.Qr, transport irma.SessionTransport,
+) (<-chan SessionEvent, SessionController) {
+	h := &eventHandler{events: make(chan SessionEvent), queued: make(chan struct{}, 1)}
+	go h.forward()
+	if session := client.newSession(ctx, qr, transport, h); session != nil {
+		h.dismisser = session
+		session.begin()
+	}
+	return h.events, h
+}
+
+// dispatchSessionEvents informs the handler of each event from the channel,
+// using the controller to pass on the answers of the handler to the session.
+func dispatchSessionEvents(events <-chan SessionEvent, controller SessionController, handler Handler) {
+	for event := range events {
+		switch e := event.(type) {
+		case StatusEvent:
+			handler.StatusUpdate(e.Action, e.Status)
+		case SuccessEvent:
+			handler.Success(e.Action, e.Result)
+		case CancelledEvent:
+			handler.Cancelled(e.Action)
+		case FailureEvent:
+			handler.Failure(e.Action, e.Err)
+		case UnsatisfiableEvent:
+			handler.UnsatisfiableRequest(e.Action, e.ServerName, e.Missing)
+		case KeyshareBlockedEvent:
+			handler.KeyshareBlocked(e.Manager, e.Duration)
+		case KeyshareEnrollmentIncompleteEvent:
+			handler.KeyshareEnrollmentIncomplete(e.Manager)
+		case KeyshareEnrollmentMissingEvent:
+			handler.KeyshareEnrollmentMissing(e.Manager)
+		case PermissionEvent:
+			callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
+				_ = controller.Permission(proceed, choice)
+			})
+			switch request := e.Request.(type) {
+			case *irma.DisclosureRequest:
+				handler.RequestVerificationPermission(*request, e.ServerName, callback)
+			case *irma.SignatureRequest:
+				handler.RequestSignaturePermission(*request, e.ServerName, callback)
+			case *irma.IssuanceRequest:
+				handler.RequestIssuancePermission(*request, e.ServerName, callback)
+			}
+		case SchemeManagerPermissionEvent:
+			handler.RequestSchemeManagerPermission(e.Manager, func(proceed bool) {
+				_ = controller.SchemeManagerPermission(proceed)
+			})
+		case PinEvent:
+			handler.RequestPin(e.RemainingAttempts, PinHandler(func(proceed bool, pin string) {
+				_ = controller.Pin(proceed, pin)
+			}))
+		}
+	}
+}
+
+// send queues the event for delivery on our channel, which is closed after the event if
+// last is true. Events after the last one are dropped.
+func (h *eventHandler) send(event SessionEvent, last bool) {
+	h.sendLock.Lock()
+	if h.last {
+		h.sendLock.Unlock()
+		return
+	}
+	h.queue = append(h.queue, event)
+	h.last = last
+	h.sendLock.Unlock()
+
+	select {
+	case h.queued <- struct{}{}:
+	default: // forward() has yet to take the events queued earlier, and will take this one too
+	}
+}
+
+// forward delivers the queued events on our channel in order, closing it after the last one.
+func (h *eventHandler) forward() {
+	for range h.queued {
+		for {
+			h.sendLock.Lock()
+			if len(h.queue) == 0 {
+				last := h.last
+				h.sendLock.Unlock()
+				if last {
+					close(h.events)
+					return
+				}
+				break
+			}
+			event := h.queue[0]
+			h.queue = h.queue[1:]
+			h.sendLock.Unlock()
+			h.events <- event
+		}
+	}
+}
+
+// Handler methods
+
+func (h *eventHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.send(StatusEvent{Action: action, Status: status}, false)
+}
+
+func (h *eventHandler) Success(action irma.Action, result string) {
+	h.send(SuccessEvent{Action: action, Result: result}, true)
+}
+
+func (h *eventHandler) Cancelled(action irma.Action) {
+	h.send(CancelledEvent{Action: action}, true)
+}
+
+func (h *eventHandler) Failure(action irma.Action, err *irma.SessionError) {
+	h.send(FailureEvent{Action: action, Err: err}, true)
+}
+
+func (h *eventHandler) UnsatisfiableRequest(action irma.Action, serverName string, missing irma.AttributeDisjunctionList) {
+	h.send(UnsatisfiableEvent{Action: action, ServerName: serverName, Missing: missing}, true)
+}
+
+func (h *eventHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.send(KeyshareBlockedEvent{Manager: manager, Duration: duration}, true)
+}
+
+func (h *eventHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.send(KeyshareEnrollmentIncompleteEvent{Manager: manager}, true)
+}
+
+func (h *eventHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.send(KeyshareEnrollmentMissingEvent{Manager: manager}, true)
+}
+
+func (h *eventHandler) RequestIssuancePermission(request irma.IssuanceRequest, serverName string, callback PermissionHandler) {
+	h.requestPermission(irma.ActionIssuing, &request, serverName, callback)
+}
+
+func (h *eventHandler) RequestVerificationPermission(request irma.DisclosureRequest, serverName string, callback PermissionHandler) {
+	h.requestPermission(irma.ActionDisclosing, &request, serverName, callback)
+}
+
+func (h *eventHandler) RequestSignaturePermission(request irma.SignatureRequest, serverName string, callback PermissionHandler) {
+	h.requestPermission(irma.ActionSigning, &request, serverName, callback)
+}
+
+func (h *eventHandler) requestPermission(
+	action irma.Action, request irma.IrmaSession, serverName string, callback PermissionHandler,
+) {
+	h.lock.Lock()
+	h.permission = callback
+	h.lock.Unlock()
+	h.send(PermissionEvent{Action: action, ServerName: serverName, Request: request}, false)
+}
+
+func (h *eventHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	h.lock.Lock()
+	h.schemeManagerPermission = callback
+	h.lock.Unlock()
+	h.send(SchemeManagerPermissionEvent{Manager: manager}, false)
+}
+
+func (h *eventHandler) RequestPin(remainingAttempts int, callback PinHandler) {
+	h.lock.Lock()
+	h.pin = callback
+	h.lock.Unlock()
+	h.send(PinEvent{RemainingAttempts: remainingAttempts}, false)
+}
+
+// SessionController methods
+
+func (h *eventHandler) Dismiss() {
+	if h.dismisser != nil {
+		h.dismisser.Dismiss()
+	}
+}
+
+func (h *eventHandler) Permission(proceed bool, choice *irma.DisclosureChoice) error {
+	h.lock.Lock()
+	callback := h.permission
+	h.permission = nil
+	h.lock.Unlock()
+	if callback == nil {
+		return errors.New("No permission was requested")
+	}
+	callback(proceed, choice)
+	return nil
+}
+
+func (h *eventHandler) SchemeManagerPermission(proceed bool) error {
+	h.lock.Lock()
+	callback := h.schemeManagerPermission
+	h.schemeManagerPermission = nil
+	h.lock.Unlock()
+	if callback == nil {
+		return errors.New("No scheme manager permission was requested")
+	}
+	go callback(proceed) // Installs the scheme manager, which we should not block on
+	return nil
+}
+
+func (h *eventHandler) Pin(proceed bool, pin string) error {
+	h.lock.Lock()
+	callback := h.pin
+	h.pin = nil
+	h.lock.Unlock()
+	if callback == nil {
+		return errors.New("No PIN was requested")
+	}
+	go callback(proceed, pin) // Continues the keyshare protocol, which we should not block on
+	return nil
+}
@@ -0,0 +1,170 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the monitoring of the expiry dates of the credentials of a Client.
+// On startup and periodically afterwards the Client checks if any of its credentials
+// are (nearly) expired, informing the ClientHandler about them so that the user can
+// renew them at their issuer, and removing expired credentials if so configured.
+
+// ExpiryCheckInterval is the interval at which a Client checks for credentials that are
+// expired or about to expire.
+var ExpiryCheckInterval = 12 * time.Hour
+
+// ExpiryHandler may optionally be implemented by a ClientHandler, to be informed that a
+// credential is (about to be) expired and should be renewed at the issuer at issuerURL.
+type ExpiryHandler interface {
+	CredentialExpiring(credential *irma.CredentialInfo, expired bool, issuerURL string)
+}
+
+// startExpiryMonitor starts checking the expiry of our credentials in the background,
+// now and every ExpiryCheckInterval afterwards, until Close() is called.
+func (client *Client) startExpiryMonitor() {
+	client.expiryStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ExpiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-client.expiryStop:
+				return
+			default:
+			}
+			client.checkExpiry()
+			select {
+			case <-client.expiryStop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the background activities of the client, i.e., checking the expiry of its credentials.
+func (client *Client) Close() {
+	client.closeOnce.Do(func() {
+		close(client.expiryStop)
+	})
+}
+
+type expiryNotification struct {
+	info    *irma.CredentialInfo
+	expired bool
+	url     string
+}
+
+// checkExpiry informs the handler of each credential that is expired, or that expires
+// within the warning period from our preferences. The handler is informed only once
+// for each credential when it is about to expire, and once when it has expired.
+// Expired credentials are removed if the preferences say so. The handler is informed only if it
+// implements ExpiryHandler.
+func (client *Client) checkExpiry() {
+	client.lock.Lock()
+	notifications, removed := client.expiringCredentials()
+	client.lock.Unlock()
+
+	if client.handler == nil {
+		return
+	}
+	if handler, ok := client.handler.(ExpiryHandler); ok {
+		for _, n := range notifications {
+			handler.CredentialExpiring(n.info, n.expired, n.url)
+		}
+	}
+	if removed {
+		client.handler.UpdateAttributes()
+	}
+}
+
+// expiringCredentials returns the credentials of which the handler should be informed
+// that they are (about to be) expired, removing expired ones if the preferences say so.
+func (client *Client) expiringCredentials() (notifications []expiryNotification, removed bool) {
+	warning := time.Now().AddDate(0, 0, client.Preferences.ExpiryWarningDays)
+	var remove []string
+
+	for _, attrlistlist := range client.attributes {
+		for index, attrs := range attrlistlist {
+			credtype := attrs.CredentialType()
+			if credtype == nil || attrs.IsValidOn(warning) {
+				continue
+			}
+			expired := !attrs.IsValid()
+			if expired && client.Preferences.RemoveExpiredCredentials {
+				remove = append(remove, attrs.Hash())
+			}
+			if notified, ok := client.expiryNotified[attrs.Hash()]; ok && notified == expired {
+				continue
+			}
+			client.expiryNotified[attrs.Hash()] = expired
+
+			info := attrs.Info()
+			info.Index = index
+			var url string
+			if issuer := client.Configuration.Issuers[credtype.IssuerIdentifier()]; issuer != nil {
+				url = issuer.URL
+			}
+			notifications = append(notifications, expiryNotification{info, expired, url})
+		}
+	}
+
+	for _, hash := range remove {
+		if err := client.removeByHash(hash); err != nil {
+			// We'll try again at the next check
+			client.Configuration.Log(irma.LogLevelWarning, "credential.removeExpired", irma.LogFields{
+				"hash": hash, "error": err.Error(),
+			})
+			continue
+		}
+		delete(client.expiryNotified, hash)
+		removed = true
+	}
+	return notifications, removed
+}
+
+// SetExpiryWarningPreference sets how many days before the expiry of a credential
+// the ClientHandler is informed about it.
+func (client *Client) SetExpiryWarningPreference(days int) {
+	client.lock.Lock()
+	client.Preferences.ExpiryWarningDays = days
+	_ = client.storage.StorePreferences(client.Preferences)
+	client.lock.Unlock()
+	client.checkExpiry()
+}
+
+// SetRemoveExpiredCredentialsPreference toggles whether or not expired credentials
+// are automatically removed.
+func (client *Client) SetRemoveExpiredCredentialsPreference(enable bool) {
+	client.lock.Lock()
+	client.Preferences.RemoveExpiredCredentials = enable
+	_ = client.storage.StorePreferences(client.Preferences)
+	client.lock.Unlock()
+	client.checkExpiry()
+}
+
+// SetExcludeExpiredCandidatesPreference toggles whether or not attributes from expired credentials
+// are left out of the disclosure candidates computed by Candidates().
+func (client *Client) SetExcludeExpiredCandidatesPreference(enable bool) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.Preferences.ExcludeExpiredCandidates = enable
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// ExpiringCredentials returns information on all credentials that are expired,
+// or that expire within the warning period from our preferences.
+func (client *Client) ExpiringCredentials() irma.CredentialInfoList {
+	client.lock.Lock()
+	warning := time.Now().AddDate(0, 0, client.Preferences.ExpiryWarningDays)
+	client.lock.Unlock()
+	list := irma.CredentialInfoList{}
+	for _, info := range client.CredentialInfoList() {
+		if info.Expires.Before(irma.Timestamp(warning)) {
+			list = append(list, info)
+		}
+	}
+	return list
+}
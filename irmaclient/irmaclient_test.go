@@ -1,10 +1,14 @@
 package irmaclient
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago"
@@ -28,6 +32,15 @@ func (i *IgnoringClientHandler) UpdateAttributes()
 func (i *IgnoringClientHandler) EnrollmentError(manager irma.SchemeManagerIdentifier, err error) {}
 func (i *IgnoringClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier)          {}
 
+type ExpiryClientHandler struct {
+	IgnoringClientHandler
+	expiring chan expiryNotification
+}
+
+func (h *ExpiryClientHandler) CredentialExpiring(cred *irma.CredentialInfo, expired bool, url string) {
+	h.expiring <- expiryNotification{cred, expired, url}
+}
+
 func parseStorage(t *testing.T) *Client {
 	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
 	manager, err := New(
@@ -37,6 +50,8 @@ func parseStorage(t *testing.T) *Client {
 		&IgnoringClientHandler{},
 	)
 	require.NoError(t, err)
+	// The credentials in our test storage have expired, but our tests disclose them anyway
+	manager.SetExcludeExpiredCandidatesPreference(false)
 	return manager
 }
 
@@ -149,6 +164,78 @@ func TestLogging(t *testing.T) {
 	test.ClearTestStorage(t)
 }
 
+func TestVerifyLoggedSignature(t *testing.T) {
+	client := parseStorage(t)
+
+	jwt := getSigningJwt("testsigclient", irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	sessionHelper(t, jwt, "signature", client)
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, irma.ActionSigning, entry.Type)
+
+	signature, err := entry.Signature()
+	require.NoError(t, err)
+	require.Equal(t, "test", signature.Request.Message)
+	require.Equal(t, entry.SessionInfo.Nonce, signature.Request.Nonce)
+	require.NotEmpty(t, signature.Signature)
+
+	result, err := client.VerifyLoggedSignature(entry)
+	require.NoError(t, err)
+	require.Equal(t, irma.VALID, result.ProofStatus)
+
+	// The signature must still be verifiable after the log entry has been stored and loaded
+	bts, err := json.Marshal(entry)
+	require.NoError(t, err)
+	loaded := &LogEntry{}
+	require.NoError(t, json.Unmarshal(bts, loaded))
+	result, err = client.VerifyLoggedSignature(loaded)
+	require.NoError(t, err)
+	require.Equal(t, irma.VALID, result.ProofStatus)
+
+	// Other log entries contain no signature
+	require.NoError(t, client.RemoveCredential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0))
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	_, err = logs[len(logs)-1].Signature()
+	require.Error(t, err)
+
+	// Nor do signature log entries whose JWT lacks a signature request
+	body := base64.RawStdEncoding.EncodeToString([]byte(`{"sub":"signature_request","iss":"testsigclient"}`))
+	entry = &LogEntry{Type: irma.ActionSigning, SessionInfo: &irma.SessionInfo{Jwt: "e30." + body + "."}}
+	_, err = entry.Signature()
+	require.Error(t, err)
+
+	test.ClearTestStorage(t)
+}
+
+// The signature of a log entry includes the preimages of disclosed attributes contained as hash.
+func TestLoggedSignaturePreimages(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	preimages := map[irma.AttributeTypeIdentifier]string{studentID: "s1234567"}
+	entry := &LogEntry{
+		Type: irma.ActionSigning,
+		SessionInfo: &irma.SessionInfo{
+			Jwt:     unsignedJwt(t, getSigningJwt("testsigclient", studentID)),
+			Nonce:   big.NewInt(42),
+			Context: big.NewInt(1337),
+		},
+		Preimages: preimages,
+		response:  gabi.ProofList{},
+	}
+
+	signature, err := entry.Signature()
+	require.NoError(t, err)
+	require.Equal(t, preimages, signature.Preimages)
+
+	bts, err := json.Marshal(entry)
+	require.NoError(t, err)
+	loaded := &LogEntry{}
+	require.NoError(t, json.Unmarshal(bts, loaded))
+	require.Equal(t, preimages, loaded.Preimages)
+}
+
 // TestCandidates tests the correctness of the function of the client that, given a disjunction of attributes
 // requested by the verifier, calculates a list of candidate attributes contained by the client that would
 // satisfy the attribute disjunction.
@@ -273,6 +360,56 @@ func TestCredentialRemoval(t *testing.T) {
 	test.ClearTestStorage(t)
 }
 
+func TestLogExport(t *testing.T) {
+	client := parseStorage(t)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.NoError(t, client.RemoveCredential(id, 0))
+
+	var buf bytes.Buffer
+	require.NoError(t, client.ExportLogs(&buf, LogExportJSON, "nl"))
+	var entries []*ExportedLogEntry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entries))
+	require.NotEmpty(t, entries)
+
+	var entry *ExportedLogEntry
+	for _, e := range entries {
+		if e.Type == actionRemoval {
+			entry = e
+		}
+	}
+	require.NotNil(t, entry)
+	require.Empty(t, entry.Requestor)
+	require.Nil(t, entry.Signature)
+	require.Len(t, entry.Removed, 4)
+	attr := entry.Removed[2]
+	require.Equal(t, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), attr.Identifier)
+	require.Equal(t, "Studentenkaart", attr.CredentialType)
+	require.Equal(t, "Studentnummer", attr.Name)
+	require.Equal(t, "456", attr.Value)
+
+	buf.Reset()
+	require.NoError(t, client.ExportLogs(&buf, LogExportCSV, "en"))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, logExportCSVHeader, rows[0])
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	var timestamp string
+	for _, log := range logs {
+		if log.Type == actionRemoval {
+			timestamp = time.Time(log.Time).Format(time.RFC3339)
+		}
+	}
+	require.Contains(t, rows, []string{
+		timestamp, "removal", "", "removed", "Student Card", "Student number", "456", "", "",
+	})
+
+	require.Error(t, client.ExportLogs(&buf, LogExportFormat("xml"), "en"))
+
+	test.ClearTestStorage(t)
+}
+
 func TestWrongSchemeManager(t *testing.T) {
 	client := parseStorage(t)
 
@@ -338,3 +475,221 @@ func TestDownloadSchemeManager(t *testing.T) {
 
 	test.ClearTestStorage(t)
 }
+
+func TestCredentialExpiry(t *testing.T) {
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	handler := &ExpiryClientHandler{expiring: make(chan expiryNotification, 10)}
+	client, err := New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		handler,
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Both credentials in our test storage have expired, of which we should be informed after startup
+	expired := map[string]bool{}
+	urls := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-handler.expiring:
+			expired[n.info.CredentialTypeID.String()] = n.expired
+			urls[n.info.CredentialTypeID.String()] = n.url
+		case <-time.After(5 * time.Second):
+			t.Fatal("Not informed of expired credentials")
+		}
+	}
+	require.True(t, expired["irma-demo.RU.studentCard"])
+	require.True(t, expired["test.test.mijnirma"])
+	require.Equal(t, "http://www.irmacard.org/credentials/phase1/RU/", urls["irma-demo.RU.studentCard"])
+	require.Len(t, client.ExpiringCredentials(), 2)
+
+	// We are informed only once per credential
+	client.checkExpiry()
+	require.Empty(t, handler.expiring)
+
+	// Expired credentials are not candidates unless configured otherwise
+	disjunction := &irma.AttributeDisjunction{
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}
+	require.Empty(t, client.Candidates(disjunction))
+	client.SetExcludeExpiredCandidatesPreference(false)
+	require.Len(t, client.Candidates(disjunction), 1)
+
+	// Expired credentials are removed when so configured
+	client.SetRemoveExpiredCredentialsPreference(true)
+	require.Empty(t, client.CredentialInfoList())
+
+	test.ClearTestStorage(t)
+}
+
+func TestPolicy(t *testing.T) {
+	client := parseStorage(t)
+	attrtype := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	candidates, missing := client.CheckSatisfiability(irma.AttributeDisjunctionList{
+		{Attributes: []irma.AttributeTypeIdentifier{attrtype}},
+	})
+	require.Empty(t, missing)
+
+	require.NoError(t, client.SetPolicy([]*PolicyRule{
+		{
+			Name:      "deny-other-value",
+			Server:    "example.com",
+			Requestor: "testsp",
+			Values:    map[irma.AttributeTypeIdentifier]string{attrtype: "123"},
+			Decision:  PolicyDeny,
+		},
+		{
+			Name:       "approve-studentid",
+			Server:     "example.com",
+			Requestor:  "testsp",
+			Actions:    []irma.Action{irma.ActionDisclosing},
+			Attributes: []irma.AttributeTypeIdentifier{attrtype},
+			Values:     map[irma.AttributeTypeIdentifier]string{attrtype: "456"},
+			Decision:   PolicyApprove,
+		},
+	}))
+
+	// The first rule does not match our attribute value, so the second one decides
+	rule, choice := client.evaluatePolicy(irma.ActionDisclosing, "example.com", "testsp", candidates)
+	require.NotNil(t, rule)
+	require.Equal(t, "approve-studentid", rule.Name)
+	require.Len(t, choice.Attributes, 1)
+	require.Equal(t, attrtype, choice.Attributes[0].Type)
+
+	// Neither rule matches other servers, unauthenticated servers, other requestors or other actions
+	rule, _ = client.evaluatePolicy(irma.ActionDisclosing, "example.org", "testsp", candidates)
+	require.Nil(t, rule)
+	rule, _ = client.evaluatePolicy(irma.ActionDisclosing, "", "testsp", candidates)
+	require.Nil(t, rule)
+	rule, _ = client.evaluatePolicy(irma.ActionDisclosing, "example.com", "othersp", candidates)
+	require.Nil(t, rule)
+	rule, _ = client.evaluatePolicy(irma.ActionSigning, "example.com", "testsp", candidates)
+	require.Nil(t, rule)
+
+	// Requestor names are not authenticated, so they can't be used without a server
+	require.Error(t, client.SetPolicy([]*PolicyRule{{Name: "requestor", Requestor: "testsp", Decision: PolicyApprove}}))
+
+	// The policy is stored along with the rest of the client
+	client, err := New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&IgnoringClientHandler{},
+	)
+	require.NoError(t, err)
+	require.Len(t, client.Policy(), 2)
+	require.Equal(t, "456", client.Policy()[1].Values[attrtype])
+
+	// Changing the returned rules does not change the policy
+	policy := client.Policy()
+	policy[1].Values[attrtype] = "123"
+	policy[1].Decision = PolicyDeny
+	policy[0] = &PolicyRule{Name: "replaced", Decision: PolicyApprove}
+	require.Equal(t, "deny-other-value", client.Policy()[0].Name)
+	require.Equal(t, "456", client.Policy()[1].Values[attrtype])
+	require.Equal(t, PolicyApprove, client.Policy()[1].Decision)
+
+	require.Error(t, client.SetPolicy([]*PolicyRule{{Name: "invalid"}}))
+
+	// A denying rule matches as soon as the request touches its attributes, even if other
+	// attributes are requested along with them, so that later rules cannot approve it
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	candidates, missing = client.CheckSatisfiability(irma.AttributeDisjunctionList{
+		{Attributes: []irma.AttributeTypeIdentifier{attrtype}},
+		{Attributes: []irma.AttributeTypeIdentifier{email}},
+	})
+	require.Empty(t, missing)
+	require.NoError(t, client.SetPolicy([]*PolicyRule{
+		{Name: "deny-studentid", Attributes: []irma.AttributeTypeIdentifier{attrtype}, Decision: PolicyDeny},
+		{Name: "approve-all", Server: "example.com", Decision: PolicyApprove},
+	}))
+	rule, _ = client.evaluatePolicy(irma.ActionDisclosing, "example.com", "testsp", candidates)
+	require.NotNil(t, rule)
+	require.Equal(t, "deny-studentid", rule.Name)
+	rule, _ = client.evaluatePolicy(irma.ActionDisclosing, "example.com", "testsp", candidates[1:])
+	require.NotNil(t, rule)
+	require.Equal(t, "approve-all", rule.Name)
+
+	// Approving rules without actions approve only disclosure sessions
+	rule, _ = client.evaluatePolicy(irma.ActionSigning, "example.com", "testsp", candidates[1:])
+	require.Nil(t, rule)
+	rule, _ = client.evaluatePolicy(irma.ActionIssuing, "example.com", "testsp", nil)
+	require.Nil(t, rule)
+
+	// Sessions refused by the policy are logged along with the deciding rule
+	require.NoError(t, client.SetPolicy([]*PolicyRule{
+		{Name: "deny-disclosure", Actions: []irma.Action{irma.ActionDisclosing}, Decision: PolicyDeny},
+	}))
+	c := make(chan *irma.SessionError, 1)
+	request := `{"nonce": 0, "context": 0, "content":[{"label":"Student number (RU)","attributes":["irma-demo.RU.studentCard.studentID"]}]}`
+	client.NewManualSessionFor(irma.ActionDisclosing, irma.NewVersion(2, 3), "NFC reader", request, TestHandler{t, c, client})
+	require.NotNil(t, <-c) // cancelled
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, irma.ActionDisclosing, entry.Type)
+	require.True(t, entry.Denied)
+	require.Equal(t, "deny-disclosure", entry.PolicyRule)
+	require.Empty(t, entry.Disclosed)
+
+	test.ClearTestStorage(t)
+}
+
+func TestDefaultChoice(t *testing.T) {
+	client := parseStorage(t)
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+
+	// The second disjunction can be satisfied by both of our credentials, but as the
+	// first one needs the studentCard anyway, we should disclose only from that one
+	request := &irma.DisclosureRequest{Content: irma.AttributeDisjunctionList{
+		{Attributes: []irma.AttributeTypeIdentifier{studentID}},
+		{Attributes: []irma.AttributeTypeIdentifier{email, university}},
+	}}
+	choice, err := client.DefaultChoice(request)
+	require.NoError(t, err)
+	require.Len(t, choice.Attributes, 2)
+	require.Equal(t, studentID, choice.Attributes[0].Type)
+	require.Equal(t, university, choice.Attributes[1].Type)
+	require.Equal(t, choice.Attributes[0].CredentialHash, choice.Attributes[1].CredentialHash)
+
+	request.Content = append(request.Content, &irma.AttributeDisjunction{
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")},
+	})
+	_, err = client.DefaultChoice(request)
+	require.Error(t, err)
+
+	test.ClearTestStorage(t)
+}
+
+func TestChooseCandidates(t *testing.T) {
+	attr := func(hash string) *irma.AttributeIdentifier {
+		return &irma.AttributeIdentifier{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), CredentialHash: hash}
+	}
+	// Credentials a and b are ranked equally, c lower (e.g. because it is expired)
+	rank := map[string]int{"a": 1, "b": 1, "c": 0}
+	equallyRanked := func(x, y *irma.AttributeIdentifier) bool {
+		return rank[x.CredentialHash] == rank[y.CredentialHash]
+	}
+
+	// Although c covers both disjunctions, the higher ranked a and b are chosen
+	choice := chooseCandidates([][]*irma.AttributeIdentifier{
+		{attr("a"), attr("c")},
+		{attr("b"), attr("c")},
+	}, equallyRanked)
+	require.Equal(t, "a", choice.Attributes[0].CredentialHash)
+	require.Equal(t, "b", choice.Attributes[1].CredentialHash)
+
+	// Among equally ranked candidates, fewer credentials are preferred
+	choice = chooseCandidates([][]*irma.AttributeIdentifier{
+		{attr("a"), attr("b")},
+		{attr("a"), attr("b"), attr("c")},
+		{attr("b")},
+	}, equallyRanked)
+	require.Equal(t, "b", choice.Attributes[0].CredentialHash)
+	require.Equal(t, "b", choice.Attributes[1].CredentialHash)
+	require.Equal(t, "b", choice.Attributes[2].CredentialHash)
+}
@@ -1,11 +1,13 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"math/big"
 	"strconv"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/mhe/gabi"
@@ -39,9 +41,9 @@ type keyshareSession struct {
 	session         irma.IrmaSession
 	conf            *irma.Configuration
 	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer
-	keyshareServer  *keyshareServer // The one keyshare server in use in case of issuance
 	transports      map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
 	state           *issuanceState
+	commitments     []*gabi.ProofPCommitment // Per builder, the commitment of its keyshare server if any
 }
 
 type keyshareServer struct {
@@ -50,7 +52,13 @@ type keyshareServer struct {
 	Nonce                   []byte              `json:"nonce"`
 	PrivateKey              *paillierPrivateKey `json:"keyPair"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
-	token                   string
+
+	// Authorization token that we received after entering our PIN, when we received it,
+	// and when it expires (if the keyshare server tells us). These are stored separately,
+	// see storeKeyshareServers().
+	Token       string          `json:"-"`
+	TokenTime   *irma.Timestamp `json:"-"`
+	TokenExpiry *irma.Timestamp `json:"-"`
 }
 
 type keyshareEnrollment struct {
@@ -69,6 +77,12 @@ type keysharePinMessage struct {
 	Pin      string `json:"pin"`
 }
 
+type keyshareChangePin struct {
+	Username string `json:"id"`
+	OldPin   string `json:"oldpin"`
+	NewPin   string `json:"newpin"`
+}
+
 type keysharePinStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
@@ -110,6 +124,8 @@ const (
 	kssPinSuccess     = "success"
 	kssPinFailure     = "failure"
 	kssPinError       = "error"
+
+	kssUserNotRegistered = "USER_NOT_REGISTERED"
 )
 
 func newKeyshareServer(
@@ -136,12 +152,70 @@ func (ks *keyshareServer) HashedPin(pin string) string {
 	return base64.StdEncoding.EncodeToString(hash[:]) + "\n"
 }
 
+// newKeyshareTransport returns a transport to the keyshare server at the specified url of the
+// specified scheme manager, that only accepts the keys that the scheme manager pins, if any.
+func newKeyshareTransport(conf *irma.Configuration, manager irma.SchemeManagerIdentifier, url string) *irma.HTTPTransport {
+	var pins []string
+	if m, ok := conf.SchemeManagers[manager]; ok {
+		pins = m.KeysharePins
+	}
+	transport := irma.NewPinnedHTTPTransport(url, pins)
+	transport.SetLogger(conf.Logger)
+	return transport
+}
+
+// copy returns a copy of this keyshare server registration, of which the authorization token
+// may be changed independently of ours.
+func (kss *keyshareServer) copy() *keyshareServer {
+	c := *kss
+	return &c
+}
+
+// setToken sets the authorization token that the keyshare server sent us after entering our PIN.
+// If the token is a JWT with an expiry date, we keep track of it.
+func (kss *keyshareServer) setToken(token string) {
+	kss.Token = token
+	kss.TokenTime, kss.TokenExpiry = nil, nil
+	if token == "" {
+		return
+	}
+	now := irma.Timestamp(time.Now())
+	kss.TokenTime = &now
+	claims := struct {
+		Expiry int64 `json:"exp"`
+	}{}
+	if err := irma.JwtDecode(token, &claims); err == nil && claims.Expiry != 0 {
+		expiry := irma.Timestamp(time.Unix(claims.Expiry, 0))
+		kss.TokenExpiry = &expiry
+	}
+}
+
+// tokenUsable returns whether or not our authorization token may be used instead of asking
+// for the PIN: i.e., it has not expired as far as we know, and we entered our PIN at most
+// gracePeriod seconds ago. A negative grace period lets the keyshare server decide alone.
+func (kss *keyshareServer) tokenUsable(gracePeriod int) bool {
+	if kss.Token == "" {
+		return false
+	}
+	now := time.Now()
+	if kss.TokenExpiry != nil && !now.Before(time.Time(*kss.TokenExpiry)) {
+		return false
+	}
+	if gracePeriod < 0 {
+		return true
+	}
+	return kss.TokenTime != nil &&
+		now.Before(time.Time(*kss.TokenTime).Add(time.Duration(gracePeriod)*time.Second))
+}
+
 // startKeyshareSession starts and completes the entire keyshare protocol with all involved keyshare servers
 // for the specified session, merging the keyshare proofs into the specified ProofBuilder's.
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
 // user cancels; or one of the keyshare servers blocks us.
 // Error, blocked or success of the keyshare session is reported back to the keyshareSessionHandler.
+// Requests to the keyshare servers are aborted when ctx is done.
 func startKeyshareSession(
+	ctx context.Context,
 	sessionHandler keyshareSessionHandler,
 	pin KeysharePinRequestor,
 	builders gabi.ProofBuilderList,
@@ -161,8 +235,10 @@ func startKeyshareSession(
 			}
 		}
 	}
+	// The IssueCommitmentMessage carries the JWT of a single keyshare server, which the issuer
+	// verifies and merges into our proofs; it has no way to do so for more than one
 	if _, issuing := session.(*irma.IssuanceRequest); issuing && ksscount > 1 {
-		err := errors.New("Issuance session involving more than one keyshare servers are not supported")
+		err := errors.New("Issuance sessions involving more than one keyshare server are not supported")
 		sessionHandler.KeyshareError(nil, err)
 		return
 	}
@@ -185,10 +261,11 @@ func startKeyshareSession(
 			continue
 		}
 
-		ks.keyshareServer = ks.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(ks.keyshareServer.URL)
-		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
-		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
+		kss := ks.keyshareServers[managerID]
+		transport := newKeyshareTransport(conf, managerID, kss.URL)
+		transport.SetContext(ctx)
+		transport.SetHeader(kssUsernameHeader, kss.Username)
+		transport.SetHeader(kssAuthHeader, kss.Token)
 		ks.transports[managerID] = transport
 
 		authstatus := &keyshareAuthorization{}
@@ -197,12 +274,15 @@ func startKeyshareSession(
 			ks.fail(managerID, err)
 			return
 		}
+		conf.Log(irma.LogLevelDebug, "keyshare.authorization", irma.LogFields{
+			"scheme": managerID.String(), "status": authstatus.Status,
+		})
 		switch authstatus.Status {
 		case kssAuthorized: // nop
 		case kssTokenExpired:
 			requestPin = true
 		default:
-			ks.sessionHandler.KeyshareError(&managerID, errors.New("Keyshare server returned unrecognized authorization status"))
+			ks.keyshareError(&managerID, errors.New("Keyshare server returned unrecognized authorization status"))
 			return
 		}
 	}
@@ -215,25 +295,47 @@ func startKeyshareSession(
 	}
 }
 
+// keyshareError logs the error and informs the session handler of it.
+func (ks *keyshareSession) keyshareError(manager *irma.SchemeManagerIdentifier, err error) {
+	fields := irma.LogFields{"error": err.Error()}
+	if manager != nil {
+		fields["scheme"] = manager.String()
+	}
+	ks.conf.Log(irma.LogLevelWarning, "keyshare.error", fields)
+	ks.sessionHandler.KeyshareError(manager, err)
+}
+
+// userNotRegistered returns whether or not the error is the keyshare server reporting that it
+// does not know us (anymore), or that our enrollment is incomplete.
+func userNotRegistered(err error) bool {
+	serr, ok := err.(*irma.SessionError)
+	return ok && serr.ApiError != nil && serr.ApiError.ErrorName == kssUserNotRegistered
+}
+
 func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error) {
 	serr, ok := err.(*irma.SessionError)
 	if ok {
 		if serr.ApiError != nil && len(serr.ApiError.ErrorName) > 0 {
 			switch serr.ApiError.ErrorName {
-			case "USER_NOT_REGISTERED":
+			case kssUserNotRegistered:
 				ks.sessionHandler.KeyshareEnrollmentIncomplete(manager)
 			case "USER_BLOCKED":
 				duration, err := strconv.Atoi(serr.ApiError.Message)
 				if err != nil { // Not really clear what to do with duration, but should never happen anyway
 					duration = -1
 				}
+				ks.conf.Log(irma.LogLevelWarning, "keyshare.blocked", irma.LogFields{
+					"scheme": manager.String(), "duration": duration,
+				})
 				ks.sessionHandler.KeyshareBlocked(manager, duration)
 			default:
-				ks.sessionHandler.KeyshareError(&manager, err)
+				ks.keyshareError(&manager, err)
 			}
+		} else {
+			ks.keyshareError(&manager, err)
 		}
 	} else {
-		ks.sessionHandler.KeyshareError(&manager, err)
+		ks.keyshareError(&manager, err)
 	}
 }
 
@@ -247,7 +349,7 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 		}
 		success, attemptsRemaining, blocked, manager, err := ks.verifyPinAttempt(pin)
 		if err != nil {
-			ks.sessionHandler.KeyshareError(&manager, err)
+			ks.keyshareError(&manager, err)
 			return
 		}
 		if blocked != 0 {
@@ -279,27 +381,13 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 			continue
 		}
 
-		kss := ks.keyshareServers[manager]
-		transport := ks.transports[manager]
-		pinmsg := keysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
-		pinresult := &keysharePinStatus{}
-		err = transport.Post("users/verify/pin", pinresult, pinmsg)
-		if err != nil {
-			return
+		success, tries, blocked, err = ks.keyshareServers[manager].verifyPin(ks.transports[manager], pin)
+		if err == nil {
+			ks.conf.Log(irma.LogLevelInfo, "keyshare.pin", irma.LogFields{
+				"scheme": manager.String(), "success": success, "tries": tries, "blocked": blocked,
+			})
 		}
-
-		switch pinresult.Status {
-		case kssPinSuccess:
-			kss.token = pinresult.Message
-			transport.SetHeader(kssAuthHeader, kss.token)
-		case kssPinFailure:
-			tries, err = strconv.Atoi(pinresult.Message)
-			return
-		case kssPinError:
-			blocked, err = strconv.Atoi(pinresult.Message)
-			return
-		default:
-			err = errors.New("Keyshare server returned unrecognized PIN status")
+		if !success {
 			return
 		}
 	}
@@ -308,6 +396,39 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 	return
 }
 
+// verifyPin verifies the specified pin at this keyshare server, using the authorization token
+// that we receive if it is correct in subsequent requests using the transport. Its return
+// values have the same meaning as those of verifyPinAttempt().
+func (kss *keyshareServer) verifyPin(transport *irma.HTTPTransport, pin string) (
+	success bool, tries int, blocked int, err error) {
+	pinmsg := keysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
+	pinresult := &keysharePinStatus{}
+	if err = transport.Post("users/verify/pin", pinresult, pinmsg); err != nil {
+		return
+	}
+	if success, tries, blocked, err = pinresult.parse(); success {
+		kss.setToken(pinresult.Message)
+		transport.SetHeader(kssAuthHeader, kss.Token)
+	}
+	return
+}
+
+// parse returns whether or not the keyshare server accepted our PIN, and if not,
+// how many attempts we have left or for how long we are blocked.
+func (status *keysharePinStatus) parse() (success bool, tries int, blocked int, err error) {
+	switch status.Status {
+	case kssPinSuccess:
+		success = true
+	case kssPinFailure:
+		tries, err = strconv.Atoi(status.Message)
+	case kssPinError:
+		blocked, err = strconv.Atoi(status.Message)
+	default:
+		err = errors.New("Keyshare server returned unrecognized PIN status")
+	}
+	return
+}
+
 // GetCommitments gets the commitments (first message in Schnorr zero-knowledge protocol)
 // of all keyshare servers of their part of the private key, and merges these commitments
 // in our own proof builders.
@@ -340,16 +461,20 @@ func (ks *keyshareSession) GetCommitments() {
 		comms := &proofPCommitmentMap{}
 		err := transport.Post("prove/getCommitments", comms, pkids[managerID])
 		if err != nil {
-			ks.sessionHandler.KeyshareError(&managerID, err)
+			ks.keyshareError(&managerID, err)
 			return
 		}
 		for pki, c := range comms.Commitments {
 			commitments[pki] = c
 		}
+		ks.conf.Log(irma.LogLevelDebug, "keyshare.commitments", irma.LogFields{
+			"scheme": managerID.String(), "count": len(comms.Commitments),
+		})
 	}
 
 	// Merge in the commitments
-	for _, builder := range ks.builders {
+	ks.commitments = make([]*gabi.ProofPCommitment, len(ks.builders))
+	for i, builder := range ks.builders {
 		pk := builder.PublicKey()
 		pki := publicKeyIdentifier{Issuer: pk.Issuer, Counter: pk.Counter}
 		comm, distributed := commitments[pki]
@@ -357,6 +482,11 @@ func (ks *keyshareSession) GetCommitments() {
 			continue
 		}
 		builder.MergeProofPCommitment(comm)
+		ks.commitments[i] = comm
+	}
+	if ks.state != nil {
+		// The credential builders come after those of the attributes to be disclosed, if any
+		ks.state.commitments = ks.commitments[len(ks.commitments)-len(ks.state.builders):]
 	}
 
 	ks.GetProofPs()
@@ -369,16 +499,6 @@ func (ks *keyshareSession) GetProofPs() {
 	_, issig := ks.session.(*irma.SignatureRequest)
 	_, issuing := ks.session.(*irma.IssuanceRequest)
 	challenge := ks.builders.Challenge(ks.session.GetContext(), ks.session.GetNonce(), issig)
-	kssChallenge := challenge
-
-	// In disclosure or signature sessions the challenge is Paillier encrypted.
-	if !issuing {
-		bytes, err := ks.keyshareServer.PrivateKey.Encrypt(challenge.Bytes())
-		if err != nil {
-			ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
-		}
-		kssChallenge = new(big.Int).SetBytes(bytes)
-	}
 
 	// Post the challenge, obtaining JWT's containing the ProofP's
 	responses := map[irma.SchemeManagerIdentifier]string{}
@@ -387,13 +507,27 @@ func (ks *keyshareSession) GetProofPs() {
 		if !distributed {
 			continue
 		}
+
+		// In disclosure or signature sessions the challenge is Paillier encrypted,
+		// using the key pair that we registered at this keyshare server.
+		kssChallenge := challenge
+		if !issuing {
+			bytes, err := ks.keyshareServers[managerID].PrivateKey.Encrypt(challenge.Bytes())
+			if err != nil {
+				ks.keyshareError(&managerID, err)
+				return
+			}
+			kssChallenge = new(big.Int).SetBytes(bytes)
+		}
+
 		var jwt string
 		err := transport.Post("prove/getResponse", &jwt, kssChallenge)
 		if err != nil {
-			ks.sessionHandler.KeyshareError(&managerID, err)
+			ks.keyshareError(&managerID, err)
 			return
 		}
 		responses[managerID] = jwt
+		ks.conf.Log(irma.LogLevelDebug, "keyshare.response", irma.LogFields{"scheme": managerID.String()})
 	}
 
 	ks.Finish(challenge, responses)
@@ -409,29 +543,53 @@ func (ks *keyshareSession) Finish(challenge *big.Int, responses map[irma.SchemeM
 	case *irma.SignatureRequest: // So we have to do this in a separate method
 		ks.finishDisclosureOrSigning(challenge, responses)
 	case *irma.IssuanceRequest:
-		// Calculate IssueCommitmentMessage, without merging in any of the received ProofP's:
-		// instead, include the keyshare server's JWT in the IssueCommitmentMessage for the
-		// issuance server to verify
-		list, err := ks.builders.BuildDistributedProofList(challenge, nil)
-		if err != nil {
-			ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
-			return
-		}
-		message := &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: ks.state.nonce2}
-		for _, response := range responses {
-			message.ProofPjwt = response
-			break
-		}
-		// TODO for new protocol version
-		//message.ProofPjwts = map[string]string{}
-		//for manager, response := range responses {
-		//	message.ProofPjwts[manager.String()] = response
-		//}
-		ks.sessionHandler.KeyshareDone(message)
+		ks.finishIssuance(challenge, responses)
 	}
 }
 
+// finishIssuance calculates the IssueCommitmentMessage. We do not merge in the ProofP of the
+// keyshare server: instead we include its JWT in the IssueCommitmentMessage, for the issuance
+// server to verify and merge. As startKeyshareSession() refuses issuance sessions involving
+// more than one keyshare server, there is exactly one such JWT.
+func (ks *keyshareSession) finishIssuance(challenge *big.Int, responses map[irma.SchemeManagerIdentifier]string) {
+	if _, ok := ks.parseProofPs(challenge, responses, false); !ok {
+		return
+	}
+	list, err := ks.builders.BuildDistributedProofList(challenge, nil)
+	if err != nil {
+		ks.keyshareError(nil, err)
+		return
+	}
+	message := &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: ks.state.nonce2}
+	for _, response := range responses {
+		message.ProofPjwt = response
+	}
+	ks.sessionHandler.KeyshareDone(message)
+}
+
 func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, responses map[irma.SchemeManagerIdentifier]string) {
+	proofPs, ok := ks.parseProofPs(challenge, responses, true)
+	if !ok {
+		return
+	}
+
+	// Create merged proofs and finish protocol
+	list, err := ks.builders.BuildDistributedProofList(challenge, proofPs)
+	if err != nil {
+		ks.keyshareError(nil, err)
+		return
+	}
+	ks.sessionHandler.KeyshareDone(list)
+}
+
+// parseProofPs parses the JWT of the keyshare server of each of the proof builders, decrypting
+// the responses if the challenge was Paillier encrypted, into a slice of ProofP's that is nil
+// at the builders not involving a keyshare server. Each response is checked against the
+// commitment of the keyshare server, so that we never merge in or forward a response that
+// would invalidate our proofs. Errors are reported to the session handler.
+func (ks *keyshareSession) parseProofPs(
+	challenge *big.Int, responses map[irma.SchemeManagerIdentifier]string, encrypted bool,
+) ([]*gabi.ProofP, bool) {
 	proofPs := make([]*gabi.ProofP, len(ks.builders))
 	for i, builder := range ks.builders {
 		// Parse each received JWT
@@ -443,25 +601,42 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 			ProofP *gabi.ProofP
 		}{}
 		if err := irma.JwtDecode(responses[managerID], &msg); err != nil {
-			ks.sessionHandler.KeyshareError(&managerID, err)
-			return
+			ks.keyshareError(&managerID, err)
+			return nil, false
+		}
+		if msg.ProofP == nil || msg.ProofP.SResponse == nil {
+			ks.keyshareError(&managerID, errors.New("Keyshare server returned no ProofP"))
+			return nil, false
 		}
-
-		// Decrypt the responses and populate a slice of ProofP's
 		proofPs[i] = msg.ProofP
-		bytes, err := ks.keyshareServer.PrivateKey.Decrypt(proofPs[i].SResponse.Bytes())
-		if err != nil {
-			ks.sessionHandler.KeyshareError(&managerID, err)
-			return
+
+		// Decrypt the response, if necessary, and check it
+		response := proofPs[i].SResponse
+		if encrypted {
+			bytes, err := ks.keyshareServers[managerID].PrivateKey.Decrypt(response.Bytes())
+			if err != nil {
+				ks.keyshareError(&managerID, err)
+				return nil, false
+			}
+			response = new(big.Int).SetBytes(bytes)
+			proofPs[i].SResponse = response
+		}
+		if !verifyProofPResponse(builder.PublicKey(), ks.commitments[i], challenge, response) {
+			ks.keyshareError(&managerID, errors.New("Keyshare server response does not match its commitment"))
+			return nil, false
 		}
-		proofPs[i].SResponse = new(big.Int).SetBytes(bytes)
 	}
+	return proofPs, true
+}
 
-	// Create merged proofs and finish protocol
-	list, err := ks.builders.BuildDistributedProofList(challenge, proofPs)
-	if err != nil {
-		ks.sessionHandler.KeyshareError(nil, err)
-		return
+// verifyProofPResponse checks that R_0^response = Pcommit * P^challenge, i.e., that the response
+// of a keyshare server proves knowledge of its part of our secret key with respect to its commitment.
+func verifyProofPResponse(pk *gabi.PublicKey, comm *gabi.ProofPCommitment, challenge, response *big.Int) bool {
+	if comm == nil || comm.P == nil || comm.Pcommit == nil || len(pk.R) == 0 {
+		return false
 	}
-	ks.sessionHandler.KeyshareDone(list)
+	lhs := new(big.Int).Exp(pk.R[0], response, pk.N)
+	rhs := new(big.Int).Exp(comm.P, challenge, pk.N)
+	rhs.Mul(rhs, comm.Pcommit).Mod(rhs, pk.N)
+	return lhs.Cmp(rhs) == 0
 }
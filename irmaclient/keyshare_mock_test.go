@@ -0,0 +1,642 @@
+package irmaclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/credentials/go-go-gadget-paillier"
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// mockKeyshareServer is an in-process implementation of the part of the keyshare server API
+// that the client uses, so that keyshare tests can run without the real keyshare server and
+// its database. Like the real one it blocks users after too many wrong PIN attempts, and
+// requires the PIN again when the authorization token that it hands out has expired.
+type mockKeyshareServer struct {
+	*httptest.Server
+
+	MaxPinAttempts      int           // Amount of wrong PINs after which users are blocked
+	BlockDuration       int           // Seconds for which users are blocked
+	TokenValidity       time.Duration // Validity of authorization tokens
+	UnregisterNoContent bool          // Respond to unregistering with 204 No Content instead of {}
+
+	conf  *irma.Configuration
+	lock  sync.Mutex
+	users map[string]*mockKeyshareUser
+}
+
+type mockKeyshareUser struct {
+	pin          string // As hashed by keyshareServer.HashedPin()
+	publicKey    *paillier.PublicKey
+	secret       *big.Int // Our share of the secret key of the user
+	attempts     int      // Wrong PIN attempts since the last correct one
+	blockedUntil time.Time
+	token        string
+	tokenExpiry  time.Time
+
+	// State of the current keyshare proof
+	commit *big.Int
+	p      *big.Int
+}
+
+// Challenges larger than this are assumed to be Paillier encrypted
+const mockKeyshareMaxChallengeBits = 256
+
+func newMockKeyshareServer(conf *irma.Configuration) *mockKeyshareServer {
+	s := &mockKeyshareServer{
+		MaxPinAttempts: 3,
+		BlockDuration:  60,
+		TokenValidity:  time.Hour,
+		conf:           conf,
+		users:          map[string]*mockKeyshareUser{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/web/users/selfenroll", s.handleEnroll)
+	mux.HandleFunc("/users/isAuthorized", s.handleIsAuthorized)
+	mux.HandleFunc("/users/verify/pin", s.handleVerifyPin)
+	mux.HandleFunc("/users/change/pin", s.handleChangePin)
+	mux.HandleFunc("/users/unregister", s.authorized(s.handleUnregister))
+	mux.HandleFunc("/prove/getCommitments", s.authorized(s.handleGetCommitments))
+	mux.HandleFunc("/prove/getResponse", s.authorized(s.handleGetResponse))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// useMockKeyshareServer starts a mock keyshare server for the test scheme manager,
+// registering the user of the client at it if the client is enrolled.
+func useMockKeyshareServer(t *testing.T, client *Client) *mockKeyshareServer {
+	manager := irma.NewSchemeManagerIdentifier("test")
+	s := newMockKeyshareServer(client.Configuration)
+	client.Configuration.SchemeManagers[manager].KeyshareServer = s.URL
+	if kss, ok := client.keyshareServers[manager]; ok {
+		kss.URL = s.URL
+		s.addUser(t, kss, "12345")
+	}
+	return s
+}
+
+// addUser registers the user of the specified keyshare server registration with the specified PIN.
+func (s *mockKeyshareServer) addUser(t *testing.T, kss *keyshareServer, pin string) {
+	pk := paillier.PublicKey(kss.PrivateKey.PublicKey)
+	secret, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 256))
+	require.NoError(t, err)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[kss.Username] = &mockKeyshareUser{pin: kss.HashedPin(pin), publicKey: &pk, secret: secret}
+}
+
+// removeUser forgets the user of the specified keyshare server registration, as if it never enrolled.
+func (s *mockKeyshareServer) removeUser(kss *keyshareServer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.users, kss.Username)
+}
+
+func (s *mockKeyshareServer) writeJSON(w http.ResponseWriter, object interface{}) {
+	bts, err := json.Marshal(object)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "SERIALIZATION", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bts)
+}
+
+func (s *mockKeyshareServer) writeError(w http.ResponseWriter, status int, name, message string) {
+	bts, _ := json.Marshal(&irma.ApiError{Status: status, ErrorName: name, Message: message})
+	w.WriteHeader(status)
+	w.Write(bts)
+}
+
+func (s *mockKeyshareServer) readJSON(w http.ResponseWriter, r *http.Request, object interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(object); err != nil {
+		s.writeError(w, http.StatusBadRequest, "MALFORMED_INPUT", err.Error())
+		return false
+	}
+	return true
+}
+
+// user returns the specified user, writing an error and returning nil if it does not exist
+// or is blocked. The caller must hold the lock.
+func (s *mockKeyshareServer) user(w http.ResponseWriter, username string) *mockKeyshareUser {
+	user, ok := s.users[username]
+	if !ok {
+		s.writeError(w, http.StatusForbidden, "USER_NOT_REGISTERED", "")
+		return nil
+	}
+	if remaining := user.blockedUntil.Sub(time.Now()); remaining > 0 {
+		s.writeError(w, http.StatusForbidden, "USER_BLOCKED", strconv.Itoa(int(remaining.Seconds())+1))
+		return nil
+	}
+	return user
+}
+
+func (user *mockKeyshareUser) authorized(token string) bool {
+	return user.token != "" && user.token == token && time.Now().Before(user.tokenExpiry)
+}
+
+// authorized wraps the handler such that it is only called with the lock held,
+// if the request is made with a valid authorization token.
+func (s *mockKeyshareServer) authorized(
+	handler func(w http.ResponseWriter, r *http.Request, user *mockKeyshareUser),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		user := s.user(w, r.Header.Get(kssUsernameHeader))
+		if user == nil {
+			return
+		}
+		if !user.authorized(r.Header.Get(kssAuthHeader)) {
+			s.writeError(w, http.StatusForbidden, "UNAUTHORIZED", "")
+			return
+		}
+		handler(w, r, user)
+	}
+}
+
+// checkPin checks the hashed PIN of the user, counting wrong attempts and blocking the user
+// after too many of them. The caller must hold the lock.
+func (s *mockKeyshareServer) checkPin(user *mockKeyshareUser, pin string) *keysharePinStatus {
+	if remaining := user.blockedUntil.Sub(time.Now()); remaining > 0 {
+		return &keysharePinStatus{Status: kssPinError, Message: strconv.Itoa(int(remaining.Seconds()) + 1)}
+	}
+	if pin != user.pin {
+		user.attempts++
+		if user.attempts >= s.MaxPinAttempts {
+			user.attempts = 0
+			user.blockedUntil = time.Now().Add(time.Duration(s.BlockDuration) * time.Second)
+			return &keysharePinStatus{Status: kssPinError, Message: strconv.Itoa(s.BlockDuration)}
+		}
+		return &keysharePinStatus{Status: kssPinFailure, Message: strconv.Itoa(s.MaxPinAttempts - user.attempts)}
+	}
+
+	user.attempts = 0
+	token := make([]byte, 16)
+	rand.Read(token)
+	user.token = base64.StdEncoding.EncodeToString(token)
+	user.tokenExpiry = time.Now().Add(s.TokenValidity)
+	return &keysharePinStatus{Status: kssPinSuccess, Message: user.token}
+}
+
+func (s *mockKeyshareServer) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	msg := struct {
+		Username  string `json:"username"`
+		Pin       string `json:"pin"`
+		PublicKey struct {
+			N        *big.Int `json:"n"`
+			G        *big.Int `json:"g"`
+			NSquared *big.Int `json:"nSquared"`
+		} `json:"publicKey"`
+	}{}
+	if !s.readJSON(w, r, &msg) {
+		return
+	}
+	secret, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 256))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "EXCEPTION", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.users[msg.Username]; exists {
+		s.writeError(w, http.StatusBadRequest, "USER_ALREADY_EXISTS", "")
+		return
+	}
+	s.users[msg.Username] = &mockKeyshareUser{
+		pin:       msg.Pin,
+		publicKey: &paillier.PublicKey{N: msg.PublicKey.N, G: msg.PublicKey.G, NSquared: msg.PublicKey.NSquared},
+		secret:    secret,
+	}
+	s.writeJSON(w, struct{}{})
+}
+
+func (s *mockKeyshareServer) handleIsAuthorized(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	user := s.user(w, r.Header.Get(kssUsernameHeader))
+	if user == nil {
+		return
+	}
+	status := kssTokenExpired
+	if user.authorized(r.Header.Get(kssAuthHeader)) {
+		status = kssAuthorized
+	}
+	s.writeJSON(w, &keyshareAuthorization{Status: status, Candidates: []string{"pin"}})
+}
+
+func (s *mockKeyshareServer) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
+	msg := keysharePinMessage{}
+	if !s.readJSON(w, r, &msg) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	user, ok := s.users[msg.Username]
+	if !ok {
+		s.writeError(w, http.StatusForbidden, "USER_NOT_REGISTERED", "")
+		return
+	}
+	s.writeJSON(w, s.checkPin(user, msg.Pin))
+}
+
+func (s *mockKeyshareServer) handleChangePin(w http.ResponseWriter, r *http.Request) {
+	msg := keyshareChangePin{}
+	if !s.readJSON(w, r, &msg) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	user, ok := s.users[msg.Username]
+	if !ok {
+		s.writeError(w, http.StatusForbidden, "USER_NOT_REGISTERED", "")
+		return
+	}
+	status := s.checkPin(user, msg.OldPin)
+	if status.Status == kssPinSuccess {
+		user.pin = msg.NewPin
+		user.token = ""
+		status.Message = ""
+	}
+	s.writeJSON(w, status)
+}
+
+func (s *mockKeyshareServer) handleUnregister(w http.ResponseWriter, r *http.Request, user *mockKeyshareUser) {
+	for username, u := range s.users {
+		if u == user {
+			delete(s.users, username)
+		}
+	}
+	if s.UnregisterNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.writeJSON(w, struct{}{})
+}
+
+// handleGetCommitments computes a commitment to our share of the secret key of the user
+// with respect to each of the requested public keys, using the same randomness for each.
+func (s *mockKeyshareServer) handleGetCommitments(w http.ResponseWriter, r *http.Request, user *mockKeyshareUser) {
+	pkids := []struct {
+		Issuer struct {
+			Identifier string `json:"identifier"`
+		} `json:"issuer"`
+		Counter uint `json:"counter"`
+	}{}
+	if !s.readJSON(w, r, &pkids) {
+		return
+	}
+
+	commit, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 1024))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "EXCEPTION", err.Error())
+		return
+	}
+	comms := [][]interface{}{}
+	for _, pkid := range pkids {
+		pk, err := s.conf.PublicKey(irma.NewIssuerIdentifier(pkid.Issuer.Identifier), int(pkid.Counter))
+		if err != nil || pk == nil || len(pk.R) == 0 {
+			s.writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", pkid.Issuer.Identifier)
+			return
+		}
+		comm := &gabi.ProofPCommitment{
+			P:       new(big.Int).Exp(pk.R[0], user.secret, pk.N),
+			Pcommit: new(big.Int).Exp(pk.R[0], commit, pk.N),
+		}
+		user.p = comm.P
+		comms = append(comms, []interface{}{
+			&publicKeyIdentifier{Issuer: pkid.Issuer.Identifier, Counter: pkid.Counter},
+			comm,
+		})
+	}
+	user.commit = commit
+	s.writeJSON(w, map[string]interface{}{"c": comms})
+}
+
+// handleGetResponse computes the response to the challenge for the last commitments, homomorphically
+// if the challenge is Paillier encrypted, and returns it in a JWT.
+func (s *mockKeyshareServer) handleGetResponse(w http.ResponseWriter, r *http.Request, user *mockKeyshareUser) {
+	challenge := new(big.Int)
+	if !s.readJSON(w, r, challenge) {
+		return
+	}
+	if user.commit == nil {
+		s.writeError(w, http.StatusBadRequest, "UNEXPECTED_REQUEST", "no commitments were requested")
+		return
+	}
+	commit := user.commit
+	user.commit = nil
+
+	var response *big.Int
+	if challenge.BitLen() <= mockKeyshareMaxChallengeBits {
+		response = new(big.Int).Add(commit, new(big.Int).Mul(challenge, user.secret))
+	} else {
+		// Enc(commit + challenge * secret) = Enc(commit) * Enc(challenge)^secret
+		encCommit, err := paillier.Encrypt(user.publicKey, commit.Bytes())
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "EXCEPTION", err.Error())
+			return
+		}
+		response = new(big.Int).Exp(challenge, user.secret, user.publicKey.NSquared)
+		response.Mul(response, new(big.Int).SetBytes(encCommit))
+		response.Mod(response, user.publicKey.NSquared)
+	}
+
+	payload, err := json.Marshal(struct {
+		ProofP *gabi.ProofP
+	}{&gabi.ProofP{P: user.p, C: challenge, SResponse: response}})
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "SERIALIZATION", err.Error())
+		return
+	}
+	header := base64.RawStdEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	w.Write([]byte(header + "." + base64.RawStdEncoding.EncodeToString(payload) + "."))
+}
+
+// mockKeyshareSessionHandler passes the outcome of a keyshare session, i.e. the message
+// on success or an error otherwise, to its result channel.
+type mockKeyshareSessionHandler struct {
+	result chan interface{}
+}
+
+func (h *mockKeyshareSessionHandler) KeyshareDone(message interface{}) { h.result <- message }
+func (h *mockKeyshareSessionHandler) KeyshareCancelled()               { h.result <- errors.New("cancelled") }
+func (h *mockKeyshareSessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.result <- errors.Errorf("blocked at %s", manager)
+}
+func (h *mockKeyshareSessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.result <- errors.Errorf("not enrolled at %s", manager)
+}
+func (h *mockKeyshareSessionHandler) KeyshareError(manager *irma.SchemeManagerIdentifier, err error) {
+	h.result <- err
+}
+func (h *mockKeyshareSessionHandler) KeysharePin()   {}
+func (h *mockKeyshareSessionHandler) KeysharePinOK() {}
+
+func TestKeyshareAuthorization(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	s := useMockKeyshareServer(t, client)
+	defer s.Close()
+
+	kss := client.keyshareServers[irma.NewSchemeManagerIdentifier("test")]
+	transport := irma.NewHTTPTransport(kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	requireAuthorization := func(expected string) {
+		status := &keyshareAuthorization{}
+		require.NoError(t, transport.Post("users/isAuthorized", status, ""))
+		require.Equal(t, expected, status.Status)
+	}
+	requireAuthorization(kssTokenExpired)
+
+	success, tries, _, err := kss.verifyPin(transport, "54321")
+	require.NoError(t, err)
+	require.False(t, success)
+	require.Equal(t, 2, tries)
+	success, _, _, err = kss.verifyPin(transport, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	requireAuthorization(kssAuthorized)
+
+	// Tokens expire
+	s.TokenValidity = 10 * time.Millisecond
+	success, _, _, err = kss.verifyPin(transport, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	time.Sleep(20 * time.Millisecond)
+	requireAuthorization(kssTokenExpired)
+
+	// Too many wrong attempts get us blocked, after which even the correct PIN is refused
+	for i := 0; i < s.MaxPinAttempts-1; i++ {
+		_, tries, _, err = kss.verifyPin(transport, "54321")
+		require.NoError(t, err)
+		require.Equal(t, s.MaxPinAttempts-1-i, tries)
+	}
+	_, _, blocked, err := kss.verifyPin(transport, "54321")
+	require.NoError(t, err)
+	require.Equal(t, s.BlockDuration, blocked)
+	success, _, blocked, err = kss.verifyPin(transport, "12345")
+	require.NoError(t, err)
+	require.False(t, success)
+	require.NotZero(t, blocked)
+
+	err = transport.Post("users/isAuthorized", &keyshareAuthorization{}, "")
+	require.Error(t, err)
+	require.Equal(t, "USER_BLOCKED", err.(*irma.SessionError).ApiError.ErrorName)
+}
+
+func TestKeyshareEnrollmentLogging(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+	manager := irma.NewSchemeManagerIdentifier("test")
+
+	var lock sync.Mutex
+	var bodies []string
+	client.Configuration.Logger = irma.LoggerFunc(func(level irma.LogLevel, event string, fields irma.LogFields) {
+		lock.Lock()
+		defer lock.Unlock()
+		if event == "http.request" && fields["url"] == client.Configuration.SchemeManagers[manager].KeyshareServer+"/web/users/selfenroll" {
+			bodies = append(bodies, fields["body"].(string))
+		}
+	})
+
+	require.NoError(t, client.KeyshareRemove(manager))
+	require.NoError(t, client.keyshareEnrollWorker(manager, "enrollment@example.com", "12345", nil))
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, bodies, 1)
+	require.NotContains(t, bodies[0], "enrollment@example.com")
+	require.NotContains(t, bodies[0], client.keyshareServers[manager].HashedPin("12345"))
+	require.Contains(t, bodies[0], `"username":"[redacted]"`)
+}
+
+func TestKeyshareProofP(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+
+	kss := client.keyshareServers[irma.NewSchemeManagerIdentifier("test")]
+	transport := irma.NewHTTPTransport(kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	success, _, _, err := kss.verifyPin(transport, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+
+	pk, err := client.Configuration.PublicKey(irma.NewIssuerIdentifier("test.test"), 2)
+	require.NoError(t, err)
+	pkid := publicKeyIdentifier{Issuer: "test.test", Counter: 2}
+
+	// Perform the keyshare protocol with a plain challenge as in issuance sessions, and
+	// with a Paillier encrypted challenge as in disclosure and signature sessions
+	for _, encrypted := range []bool{false, true} {
+		comms := &proofPCommitmentMap{}
+		require.NoError(t, transport.Post("prove/getCommitments", comms, []*publicKeyIdentifier{&pkid}))
+		require.Contains(t, comms.Commitments, pkid)
+		comm := comms.Commitments[pkid]
+
+		challenge, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 256))
+		require.NoError(t, err)
+		kssChallenge := challenge
+		if encrypted {
+			bytes, err := kss.PrivateKey.Encrypt(challenge.Bytes())
+			require.NoError(t, err)
+			kssChallenge = new(big.Int).SetBytes(bytes)
+		}
+		var jwt string
+		require.NoError(t, transport.Post("prove/getResponse", &jwt, kssChallenge))
+		msg := struct {
+			ProofP *gabi.ProofP
+		}{}
+		require.NoError(t, irma.JwtDecode(jwt, &msg))
+		response := msg.ProofP.SResponse
+		if encrypted {
+			bytes, err := kss.PrivateKey.Decrypt(response.Bytes())
+			require.NoError(t, err)
+			response = new(big.Int).SetBytes(bytes)
+		}
+
+		// R_0^response = Pcommit * P^challenge
+		lhs := new(big.Int).Exp(pk.R[0], response, pk.N)
+		rhs := new(big.Int).Exp(comm.P, challenge, pk.N)
+		rhs.Mul(rhs, comm.Pcommit).Mod(rhs, pk.N)
+		require.Zero(t, lhs.Cmp(rhs))
+	}
+}
+
+// SecureStorageClientHandler keeps the secrets of the SecureStorage interface in memory.
+type SecureStorageClientHandler struct {
+	IgnoringClientHandler
+	secrets map[string][]byte
+}
+
+func (h *SecureStorageClientHandler) StoreSecret(name string, secret []byte) error {
+	h.secrets[name] = secret
+	return nil
+}
+
+func (h *SecureStorageClientHandler) LoadSecret(name string) ([]byte, error) {
+	return h.secrets[name], nil
+}
+
+func TestKeyshareTokenPersistence(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+	manager := irma.NewSchemeManagerIdentifier("test")
+	handler := &SecureStorageClientHandler{secrets: map[string][]byte{}}
+	client.handler = handler
+
+	// Obtain a token during a session, which is saved afterwards
+	servers := client.sessionKeyshareServers()
+	kss := servers[manager]
+	transport := irma.NewHTTPTransport(kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	success, _, _, err := kss.verifyPin(transport, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NoError(t, client.storeKeyshareTokens(servers))
+
+	// The token is stored in our SecureStorage and not along with our keyshare servers
+	require.Contains(t, string(handler.secrets[keyshareTokensSecret]), kss.Token)
+	bts, err := ioutil.ReadFile(client.storage.path(kssFile))
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), kss.Token)
+
+	// After a restart the token can still be used
+	loaded, err := client.storage.LoadKeyshareServers()
+	require.NoError(t, err)
+	require.Empty(t, loaded[manager].Token)
+	client.keyshareServers = loaded
+	require.NoError(t, client.loadKeyshareTokens())
+	require.Equal(t, kss.Token, loaded[manager].Token)
+	require.True(t, loaded[manager].tokenUsable(-1))
+	transport = irma.NewHTTPTransport(kss.URL)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	transport.SetHeader(kssAuthHeader, loaded[manager].Token)
+	status := &keyshareAuthorization{}
+	require.NoError(t, transport.Post("users/isAuthorized", status, ""))
+	require.Equal(t, kssAuthorized, status.Status)
+
+	// Unless our PIN grace period has passed
+	require.Equal(t, kss.Token, client.sessionKeyshareServers()[manager].Token)
+	client.SetKeysharePinGracePeriodPreference(0)
+	require.Empty(t, client.sessionKeyshareServers()[manager].Token)
+	client.SetKeysharePinGracePeriodPreference(3600)
+	require.Equal(t, kss.Token, client.sessionKeyshareServers()[manager].Token)
+
+	// Tokens that we know to be expired are not used
+	claims := base64.RawStdEncoding.EncodeToString([]byte(`{"exp":1000000000}`))
+	kss.setToken("eyJhbGciOiJub25lIn0." + claims + ".")
+	require.NotNil(t, kss.TokenExpiry)
+	require.False(t, kss.tokenUsable(-1))
+
+	// Without a SecureStorage the token is kept in memory only
+	client.handler = &IgnoringClientHandler{}
+	handler.secrets = map[string][]byte{}
+	servers = client.sessionKeyshareServers()
+	servers[manager].setToken(kss.Token)
+	require.NoError(t, client.storeKeyshareTokens(servers))
+	require.Empty(t, handler.secrets)
+	require.Equal(t, kss.Token, client.keyshareServers[manager].Token)
+	client.keyshareServers, err = client.storage.LoadKeyshareServers()
+	require.NoError(t, err)
+	require.NoError(t, client.loadKeyshareTokens())
+	require.Empty(t, client.keyshareServers[manager].Token)
+}
+
+// Issuance sessions involving the keyshare servers of two scheme managers are refused, as the issuer
+// cannot verify and merge in the responses of more than one keyshare server
+func TestKeyshareMultipleServers(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+	manager := irma.NewSchemeManagerIdentifier("test")
+
+	// Let the irma-demo scheme manager have a keyshare server too, at which we are registered
+	demo := irma.NewSchemeManagerIdentifier("irma-demo")
+	s := newMockKeyshareServer(client.Configuration)
+	defer s.Close()
+	client.Configuration.SchemeManagers[demo].KeyshareServer = s.URL
+	kss, err := newKeyshareServer(demo, client.keyshareServers[manager].PrivateKey, s.URL, "demo@example.com")
+	require.NoError(t, err)
+	s.addUser(t, kss, "12345")
+	client.keyshareServers[demo] = kss
+
+	request := getIssuanceRequest(true)
+	credid := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	request.Credentials = append(request.Credentials, &irma.CredentialRequest{
+		CredentialTypeID: &credid,
+		Attributes:       map[string]string{"email": "demo@example.com"},
+	})
+	request.Context = big.NewInt(1)
+	request.Nonce = big.NewInt(1)
+	request.SetVersion(irma.NewVersion(2, 3))
+	builders, state, err := client.issuanceProofBuilders(request)
+	require.NoError(t, err)
+
+	h := &mockKeyshareSessionHandler{make(chan interface{}, 1)}
+	startKeyshareSession(context.Background(), h, TestHandler{t, nil, client}, builders, request,
+		client.Configuration, client.sessionKeyshareServers(), state)
+	result := <-h.result
+	err, ok := result.(error)
+	require.True(t, ok)
+	require.Contains(t, err.Error(), "more than one keyshare server")
+	require.Empty(t, state.commitments)
+}
@@ -0,0 +1,79 @@
+package irmaclient
+
+import (
+	"encoding/json"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the storage of the authorization tokens that keyshare servers hand out
+// after the user entered their PIN. Anyone who obtains such a token can use the keyshare server
+// on behalf of the user until it expires, so the tokens are not stored along with our keyshare
+// server registrations. They are persisted only if the ClientHandler implements SecureStorage;
+// otherwise they are kept in memory only, so that the PIN is asked again after a restart.
+
+// SecureStorage may optionally be implemented by a ClientHandler to keep secrets in storage that
+// is protected by the platform, e.g. the Android keystore or the iOS keychain. LoadSecret returns
+// nil if no secret was stored under the specified name.
+type SecureStorage interface {
+	StoreSecret(name string, secret []byte) error
+	LoadSecret(name string) ([]byte, error)
+}
+
+const keyshareTokensSecret = "keyshareTokens"
+
+// keyshareToken is the authorization token of one of our keyshare server registrations.
+type keyshareToken struct {
+	Username    string          `json:"username"`
+	Token       string          `json:"token"`
+	TokenTime   *irma.Timestamp `json:"tokenTime,omitempty"`
+	TokenExpiry *irma.Timestamp `json:"tokenExpiry,omitempty"`
+}
+
+// storeKeyshareServers saves our keyshare server registrations, and separately their
+// authorization tokens if we have a SecureStorage. The caller must hold the lock.
+func (client *Client) storeKeyshareServers() error {
+	if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+		return err
+	}
+
+	store, ok := client.handler.(SecureStorage)
+	if !ok {
+		return nil
+	}
+	tokens := map[irma.SchemeManagerIdentifier]*keyshareToken{}
+	for id, kss := range client.keyshareServers {
+		if kss.Token != "" {
+			tokens[id] = &keyshareToken{kss.Username, kss.Token, kss.TokenTime, kss.TokenExpiry}
+		}
+	}
+	bts, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return store.StoreSecret(keyshareTokensSecret, bts)
+}
+
+// loadKeyshareTokens loads the authorization tokens from our SecureStorage, if any, into the
+// keyshare server registrations to which they belong. The caller must hold the lock.
+func (client *Client) loadKeyshareTokens() error {
+	store, ok := client.handler.(SecureStorage)
+	if !ok {
+		return nil
+	}
+	bts, err := store.LoadSecret(keyshareTokensSecret)
+	if err != nil || bts == nil {
+		return err
+	}
+
+	tokens := map[irma.SchemeManagerIdentifier]*keyshareToken{}
+	if err = json.Unmarshal(bts, &tokens); err != nil {
+		return err
+	}
+	for id, token := range tokens {
+		if kss, ok := client.keyshareServers[id]; ok && kss.Username == token.Username {
+			kss.Token, kss.TokenTime, kss.TokenExpiry = token.Token, token.TokenTime, token.TokenExpiry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package irmaclient
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains functionality for exporting the log entries of a Client
+// to a human-readable report, e.g. so that the user can see what was disclosed,
+// to whom, and when.
+
+// LogExportFormat is the file format of a log export.
+type LogExportFormat string
+
+// Supported log export formats
+const (
+	LogExportJSON = LogExportFormat("json")
+	LogExportCSV  = LogExportFormat("csv")
+)
+
+// ExportedLogEntry is a human-readable version of a LogEntry, with all attribute
+// and credential type names translated into a single language.
+type ExportedLogEntry struct {
+	Type      irma.Action          `json:"type"`
+	Time      irma.Timestamp       `json:"time"`
+	Requestor string               `json:"requestor,omitempty"`
+	Denied    bool                 `json:"denied,omitempty"`
+	Disclosed []*ExportedAttribute `json:"disclosed,omitempty"`
+	Received  []*ExportedAttribute `json:"received,omitempty"`
+	Removed   []*ExportedAttribute `json:"removed,omitempty"`
+	Signature *irma.SignedMessage  `json:"signature,omitempty"`
+}
+
+// ExportedAttribute is a single attribute occuring in an ExportedLogEntry.
+type ExportedAttribute struct {
+	Identifier     irma.AttributeTypeIdentifier `json:"id"`
+	CredentialType string                       `json:"credential"`
+	Name           string                       `json:"name"`
+	Value          string                       `json:"value"`
+}
+
+var logExportCSVHeader = []string{
+	"time", "type", "requestor", "category", "credential", "attribute", "value", "message", "signature",
+}
+
+// ExportLogs writes all log entries of past events to w in the specified format,
+// translating attribute and credential type names to the specified language.
+func (client *Client) ExportLogs(w io.Writer, format LogExportFormat, lang string) error {
+	logs, err := client.Logs()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]*ExportedLogEntry, 0, len(logs))
+	for _, log := range logs {
+		entry, err := client.exportLogEntry(log, lang)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	switch format {
+	case LogExportJSON:
+		bts, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bts)
+		return err
+	case LogExportCSV:
+		return writeLogExportCSV(w, entries)
+	default:
+		return errors.New("Unsupported log export format")
+	}
+}
+
+func (client *Client) exportLogEntry(entry *LogEntry, lang string) (*ExportedLogEntry, error) {
+	exported := &ExportedLogEntry{
+		Type:   entry.Type,
+		Time:   entry.Time,
+		Denied: entry.Denied,
+	}
+
+	if entry.Type != actionRemoval && entry.SessionInfo != nil {
+		jwt, err := entry.Jwt()
+		if err != nil {
+			return nil, err
+		}
+		exported.Requestor = jwt.Requestor()
+
+		if entry.Type == irma.ActionSigning && !entry.Denied {
+			if exported.Signature, err = entry.Signature(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The keys of the Disclosed map are indices in the disclosed attributes of a gabi proof,
+	// which start at 2 (0 being the secret key and 1 the metadata attribute)
+	disclosed := make([]irma.CredentialTypeIdentifier, 0, len(entry.Disclosed))
+	for credid := range entry.Disclosed {
+		disclosed = append(disclosed, credid)
+	}
+	for _, credid := range sortCredentialTypes(disclosed) {
+		attrs := entry.Disclosed[credid]
+		indices := make([]int, 0, len(attrs))
+		for i := range attrs {
+			indices = append(indices, i)
+		}
+		sort.Ints(indices)
+		for _, i := range indices {
+			exported.Disclosed = append(exported.Disclosed, client.exportAttribute(credid, i-2, attrs[i], lang))
+		}
+	}
+	exported.Received = client.exportAttributeLists(entry.Received, lang)
+	exported.Removed = client.exportAttributeLists(entry.Removed, lang)
+
+	return exported, nil
+}
+
+func (client *Client) exportAttributeLists(
+	lists map[irma.CredentialTypeIdentifier][]irma.TranslatedString, lang string,
+) []*ExportedAttribute {
+	ids := make([]irma.CredentialTypeIdentifier, 0, len(lists))
+	for credid := range lists {
+		ids = append(ids, credid)
+	}
+	var exported []*ExportedAttribute
+	for _, credid := range sortCredentialTypes(ids) {
+		for i, value := range lists[credid] {
+			if value == nil { // optional attribute that was not issued
+				continue
+			}
+			exported = append(exported, client.exportAttribute(credid, i, value, lang))
+		}
+	}
+	return exported
+}
+
+// sortCredentialTypes sorts the specified credential types (e.g. the keys of a map) in place and
+// returns them, so that exports of the same log entry are always the same.
+func sortCredentialTypes(ids []irma.CredentialTypeIdentifier) []irma.CredentialTypeIdentifier {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	return ids
+}
+
+// exportAttribute translates the specified attribute, being the index-th attribute
+// of the specified credential type, to the specified language.
+func (client *Client) exportAttribute(
+	credid irma.CredentialTypeIdentifier, index int, value irma.TranslatedString, lang string,
+) *ExportedAttribute {
+	attr := &ExportedAttribute{
+		CredentialType: credid.String(),
+		Value:          translate(value, lang),
+	}
+
+	credtype := client.Configuration.CredentialTypes[credid]
+	if credtype == nil || index < 0 || index >= len(credtype.Attributes) {
+		// We no longer know the credential type, so we can't give the attribute a name
+		return attr
+	}
+
+	description := credtype.Attributes[index]
+	attr.Identifier = description.GetAttributeTypeIdentifier(credid)
+	attr.Name = description.ID
+	if name := translate(description.Name, lang); name != "" {
+		attr.Name = name
+	}
+	if name := translate(credtype.Name, lang); name != "" {
+		attr.CredentialType = name
+	}
+	return attr
+}
+
+// translate returns the translation of ts in the specified language, falling back
+// to English if it is not available in that language.
+func translate(ts irma.TranslatedString, lang string) string {
+	if str, ok := ts[lang]; ok {
+		return str
+	}
+	return ts["en"]
+}
+
+func writeLogExportCSV(w io.Writer, entries []*ExportedLogEntry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(logExportCSVHeader); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		timestamp := time.Time(entry.Time).Format(time.RFC3339)
+		var message, signature string
+		if entry.Signature != nil {
+			message = entry.Signature.Request.Message
+			bts, err := json.Marshal(entry.Signature)
+			if err != nil {
+				return err
+			}
+			signature = string(bts)
+		}
+
+		// Write one row per attribute, or a single row if the entry involves no attributes
+		rows := 0
+		for _, category := range []struct {
+			name  string
+			attrs []*ExportedAttribute
+		}{
+			{"disclosed", entry.Disclosed},
+			{"received", entry.Received},
+			{"removed", entry.Removed},
+		} {
+			for _, attr := range category.attrs {
+				err := writer.Write([]string{
+					timestamp, string(entry.Type), entry.Requestor, category.name,
+					attr.CredentialType, attr.Name, attr.Value, message, signature,
+				})
+				if err != nil {
+					return err
+				}
+				rows++
+			}
+		}
+		if rows == 0 {
+			var category string
+			if entry.Denied {
+				category = "denied"
+			}
+			err := writer.Write([]string{
+				timestamp, string(entry.Type), entry.Requestor, category, "", "", "", message, signature,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
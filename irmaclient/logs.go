@@ -2,6 +2,7 @@ package irmaclient
 
 import (
 	"encoding/json"
+	"math/big"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -22,6 +23,12 @@ type LogEntry struct {
 	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString       // In case of credential removal
 	SignedMessage     []byte                                                          // In case of signature sessions
 	SignedMessageType string                                                          // In case of signature sessions
+	SignatureNonce    *big.Int                                                        // In case of signature sessions
+	SignatureContext  *big.Int                                                        // In case of signature sessions
+	SignatureContent  irma.AttributeDisjunctionList                                   // In case of signature sessions: the requested attributes
+	Preimages         map[irma.AttributeTypeIdentifier]string                         // Values of disclosed attributes contained as hash
+	PolicyRule        string                                                          // Name of the policy rule that decided on the session, if any
+	Denied            bool                                                            // Whether the policy rule refused the session, in which case there was no response
 
 	response    interface{}     // Our response (ProofList or IssueCommitmentMessage)
 	rawResponse json.RawMessage // Unparsed []byte version of response
@@ -36,14 +43,24 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		SessionInfo: session.info,
 		response:    response,
 	}
+	if session.rule != nil {
+		entry.PolicyRule = session.rule.Name
+	}
+	if len(session.preimages) > 0 {
+		entry.Preimages = session.preimages
+	}
 
 	// Populate session type-specific fields of the log entry (except for .Disclosed which is handled below)
 	var prooflist gabi.ProofList
 	var ok bool
 	switch entry.Type {
 	case irma.ActionSigning:
-		entry.SignedMessage = []byte(session.jwt.(*irma.SignatureRequestorJwt).Request.Request.Message)
-		entry.SignedMessageType = session.jwt.(*irma.SignatureRequestorJwt).Request.Request.MessageType
+		request := session.irmaSession.(*irma.SignatureRequest)
+		entry.SignedMessage = []byte(request.Message)
+		entry.SignedMessageType = request.MessageType
+		entry.SignatureNonce = request.Nonce
+		entry.SignatureContext = request.Context
+		entry.SignatureContent = request.Content
 		fallthrough
 	case irma.ActionDisclosing:
 		if prooflist, ok = response.(gabi.ProofList); !ok {
@@ -53,8 +70,8 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		if entry.Received == nil {
 			entry.Received = map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 		}
-		for _, req := range session.jwt.(*irma.IdentityProviderJwt).Request.Request.Credentials {
-			list, err := req.AttributeList(session.client.Configuration, getMetadataVersion(session.Version))
+		for _, req := range session.irmaSession.(*irma.IssuanceRequest).Credentials {
+			list, err := req.AttributeList(session.client.Configuration, session.Version.Features().MetadataVersion)
 			if err != nil {
 				continue // TODO?
 			}
@@ -77,13 +94,20 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 				entry.Disclosed = map[irma.CredentialTypeIdentifier]map[int]irma.TranslatedString{}
 			}
 			meta := irma.MetadataFromInt(proofd.ADisclosed[1], session.client.Configuration)
-			id := meta.CredentialType().Identifier()
+			credtype := meta.CredentialType()
+			id := credtype.Identifier()
 			entry.Disclosed[id] = map[int]irma.TranslatedString{}
 			for i, attr := range proofd.ADisclosed {
 				if i == 1 {
 					continue
 				}
 				val := string(attr.Bytes())
+				if i-2 >= 0 && i-2 < len(credtype.Attributes) {
+					attrid := credtype.Attributes[i-2].GetAttributeTypeIdentifier(id)
+					if preimage, present := entry.Preimages[attrid]; present {
+						val = preimage
+					}
+				}
 				entry.Disclosed[id][i] = irma.TranslatedString{"en": val, "nl": val}
 			}
 		}
@@ -95,19 +119,25 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 // Jwt returns the JWT from the requestor that started the IRMA session which the
 // current log entry tracks.
 func (entry *LogEntry) Jwt() (irma.RequestorJwt, error) {
+	if entry.SessionInfo == nil {
+		return nil, errors.New("Log entry has no session info (e.g. a manual session)")
+	}
 	return irma.ParseRequestorJwt(entry.Type, entry.SessionInfo.Jwt)
 }
 
 // GetResponse returns our response to the requestor from the log entry.
 func (entry *LogEntry) GetResponse() (interface{}, error) {
 	if entry.response == nil {
+		if entry.Denied {
+			return nil, nil
+		}
 		switch entry.Type {
 		case actionRemoval:
 			return nil, nil
 		case irma.ActionSigning:
 			fallthrough
 		case irma.ActionDisclosing:
-			entry.response = []*gabi.ProofD{}
+			entry.response = &gabi.ProofList{}
 		case irma.ActionIssuing:
 			entry.response = &gabi.IssueCommitmentMessage{}
 		default:
@@ -115,13 +145,77 @@ func (entry *LogEntry) GetResponse() (interface{}, error) {
 		}
 		err := json.Unmarshal(entry.rawResponse, entry.response)
 		if err != nil {
+			entry.response = nil
 			return nil, err
 		}
+		// createLogEntry() stores ProofLists by value, so we do the same here
+		if list, ok := entry.response.(*gabi.ProofList); ok {
+			entry.response = *list
+		}
 	}
 
 	return entry.response, nil
 }
 
+// Signature returns the attribute-based signature that was created in the signature session
+// that this log entry tracks, along with the signature request (including nonce and context)
+// that it was created for, so that it can be verified later on by anyone.
+func (entry *LogEntry) Signature() (*irma.SignedMessage, error) {
+	if entry.Type != irma.ActionSigning {
+		return nil, errors.New("Log entry is not of a signature session")
+	}
+	if entry.Denied {
+		return nil, errors.New("Signature session was refused by the disclosure policy")
+	}
+
+	request, err := entry.signatureRequest()
+	if err != nil {
+		return nil, err
+	}
+	response, err := entry.GetResponse()
+	if err != nil {
+		return nil, err
+	}
+	prooflist, ok := response.(gabi.ProofList)
+	if !ok {
+		return nil, errors.New("Response was not a ProofList")
+	}
+
+	return &irma.SignedMessage{Request: request, Signature: prooflist, Preimages: entry.Preimages}, nil
+}
+
+// signatureRequest reconstructs the signature request of the signature session that this log
+// entry tracks. Log entries from before the request was logged along with the signed message
+// contain it only in the requestor JWT.
+func (entry *LogEntry) signatureRequest() (*irma.SignatureRequest, error) {
+	if entry.SignatureNonce != nil {
+		return &irma.SignatureRequest{
+			DisclosureRequest: irma.DisclosureRequest{
+				SessionRequest: irma.SessionRequest{Nonce: entry.SignatureNonce, Context: entry.SignatureContext},
+				Content:        entry.SignatureContent,
+			},
+			Message:     string(entry.SignedMessage),
+			MessageType: entry.SignedMessageType,
+		}, nil
+	}
+
+	if entry.SessionInfo == nil {
+		return nil, errors.New("Log entry does not contain a signature request")
+	}
+	jwt, err := entry.Jwt()
+	if err != nil {
+		return nil, err
+	}
+	sigjwt, ok := jwt.(*irma.SignatureRequestorJwt)
+	if !ok || sigjwt.Request.Request == nil {
+		return nil, errors.New("Log entry does not contain a signature request")
+	}
+	request := sigjwt.Request.Request
+	request.SetNonce(entry.SessionInfo.Nonce)
+	request.SetContext(entry.SessionInfo.Context)
+	return request, nil
+}
+
 type jsonLogEntry struct {
 	Type        irma.Action
 	Time        irma.Timestamp
@@ -132,6 +226,12 @@ type jsonLogEntry struct {
 	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString       `json:",omitempty"`
 	SignedMessage     []byte                                                          `json:",omitempty"`
 	SignedMessageType string                                                          `json:",omitempty"`
+	SignatureNonce    *big.Int                                                        `json:",omitempty"`
+	SignatureContext  *big.Int                                                        `json:",omitempty"`
+	SignatureContent  irma.AttributeDisjunctionList                                   `json:",omitempty"`
+	Preimages         map[irma.AttributeTypeIdentifier]string                         `json:",omitempty"`
+	PolicyRule        string                                                          `json:",omitempty"`
+	Denied            bool                                                            `json:",omitempty"`
 
 	Response json.RawMessage
 }
@@ -145,22 +245,33 @@ func (entry *LogEntry) UnmarshalJSON(bytes []byte) error {
 	}
 
 	*entry = LogEntry{
-		Type: temp.Type,
-		Time: temp.Time,
-		SessionInfo: &irma.SessionInfo{
-			Jwt:     temp.SessionInfo.Jwt,
-			Nonce:   temp.SessionInfo.Nonce,
-			Context: temp.SessionInfo.Context,
-			Keys:    make(map[irma.IssuerIdentifier]int),
-		},
+		Type:              temp.Type,
+		Time:              temp.Time,
 		Removed:           temp.Removed,
 		Disclosed:         temp.Disclosed,
 		Received:          temp.Received,
 		SignedMessage:     temp.SignedMessage,
 		SignedMessageType: temp.SignedMessageType,
+		SignatureNonce:    temp.SignatureNonce,
+		SignatureContext:  temp.SignatureContext,
+		SignatureContent:  temp.SignatureContent,
+		Preimages:         temp.Preimages,
+		PolicyRule:        temp.PolicyRule,
+		Denied:            temp.Denied,
 		rawResponse:       temp.Response,
 	}
 
+	// Removal log entries have no session info
+	if temp.SessionInfo == nil {
+		return nil
+	}
+	entry.SessionInfo = &irma.SessionInfo{
+		Jwt:     temp.SessionInfo.Jwt,
+		Nonce:   temp.SessionInfo.Nonce,
+		Context: temp.SessionInfo.Context,
+		Keys:    make(map[irma.IssuerIdentifier]int),
+	}
+
 	// TODO remove on protocol upgrade
 	for iss, count := range temp.SessionInfo.Keys {
 		entry.SessionInfo.Keys[irma.NewIssuerIdentifier(iss)] = count
@@ -203,6 +314,12 @@ func (entry *LogEntry) MarshalJSON() ([]byte, error) {
 		Received:          entry.Received,
 		SignedMessage:     entry.SignedMessage,
 		SignedMessageType: entry.SignedMessageType,
+		SignatureNonce:    entry.SignatureNonce,
+		SignatureContext:  entry.SignatureContext,
+		SignatureContent:  entry.SignatureContent,
+		Preimages:         entry.Preimages,
+		PolicyRule:        entry.PolicyRule,
+		Denied:            entry.Denied,
 	}
 
 	return json.Marshal(temp)
@@ -3,10 +3,13 @@ package irmaclient
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 
 	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -89,6 +92,26 @@ func TestManualSession(t *testing.T) {
 		t.Logf("Invalid attribute result value: %v Expected: %v", attrStatus, irma.PRESENT)
 		t.Fail()
 	}
+
+	// The signature can be verified from the log, which has no session info in manual sessions
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, irma.ActionSigning, entry.Type)
+	require.Nil(t, entry.SessionInfo)
+	sigResult, err := client.VerifyLoggedSignature(entry)
+	require.NoError(t, err)
+	require.Equal(t, irma.VALID, sigResult.ProofStatus)
+
+	// Also after storing and loading the log
+	bts, err := json.Marshal(entry)
+	require.NoError(t, err)
+	loaded := &LogEntry{}
+	require.NoError(t, json.Unmarshal(bts, loaded))
+	sigResult, err = client.VerifyLoggedSignature(loaded)
+	require.NoError(t, err)
+	require.Equal(t, irma.VALID, sigResult.ProofStatus)
+
 	test.ClearTestStorage(t)
 }
 
@@ -210,6 +233,9 @@ func TestManualKeyShareSession(t *testing.T) {
 	ms := createManualSessionHandler(request, request, t)
 
 	client = parseStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+	removeKeyshareCredential(t, client)
+	issueKeyshareCredential(t, client)
 	client.NewManualSession(request, &ms)
 
 	if err := <-ms.errorChannel; err != nil {
@@ -352,3 +378,133 @@ func (sh *ManualSessionHandler) KeyshareEnrollmentIncomplete(manager irma.Scheme
 func (sh *ManualSessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
 	sh.errorChannel <- &irma.SessionError{Err: errors.Errorf("Missing keyshare server %s", manager.String())}
 }
+
+type manualResultHandler struct {
+	TestHandler
+	result chan string
+}
+
+func (h manualResultHandler) Success(action irma.Action, result string) {
+	h.result <- result
+}
+
+// Test a manual disclosure session, and that a manual session of an unknown type fails
+func TestManualDisclosureSession(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := "{\"nonce\": 0, \"context\": 0, \"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"
+	c := make(chan *irma.SessionError, 1)
+	h := manualResultHandler{TestHandler{t, c, client}, make(chan string)}
+	session := client.NewManualSessionFor(irma.ActionDisclosing, irma.NewVersion(2, 3), "NFC reader", request, h)
+	require.NotNil(t, session)
+
+	var result string
+	select {
+	case result = <-h.result:
+	case err := <-c:
+		t.Fatal(err)
+	}
+	proofs := gabi.ProofList{}
+	require.NoError(t, json.Unmarshal([]byte(result), &proofs))
+	require.Len(t, proofs, 1)
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.NotEmpty(t, logs)
+	require.Equal(t, irma.ActionDisclosing, logs[len(logs)-1].Type)
+
+	// There are no commitments that the issuer could have signed
+	require.Error(t, session.ReceiveSignatures("[]"))
+
+	session = client.NewManualSessionFor(irma.ActionUnknown, irma.NewVersion(2, 3), "NFC reader", request, h)
+	require.Nil(t, session)
+	require.Equal(t, irma.ErrorUnknownAction, (<-c).ErrorType)
+}
+
+// issueManually performs a manual issuance session of the specified request using the handler,
+// acting as the issuer by signing the commitments with the private keys from the testdata. If a
+// keyshare server took part, its part of our secret key is included using the JWT that it sent.
+// It returns the session and the signatures that were passed to it.
+func issueManually(t *testing.T, client *Client, request *irma.IssuanceRequest, h manualResultHandler) (ManualSession, string) {
+	if request.Context == nil {
+		request.Context = big.NewInt(1)
+	}
+	if request.Nonce == nil {
+		request.Nonce = big.NewInt(1)
+	}
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	version := irma.NewVersion(2, 3)
+	session := client.NewManualSessionFor(irma.ActionIssuing, version, "NFC reader", string(bts), h)
+	require.NotNil(t, session)
+
+	var result string
+	select {
+	case result = <-h.result:
+	case err := <-h.c:
+		t.Fatal(err)
+	}
+	commitments := &gabi.IssueCommitmentMessage{}
+	require.NoError(t, json.Unmarshal([]byte(result), commitments))
+	// The proofs of the credentials come after those of the disclosed attributes, if any
+	require.True(t, len(commitments.Proofs) >= len(request.Credentials))
+	proofs := commitments.Proofs[len(commitments.Proofs)-len(request.Credentials):]
+	var proofP *gabi.ProofP
+	if commitments.ProofPjwt != "" {
+		msg := struct {
+			ProofP *gabi.ProofP
+		}{}
+		require.NoError(t, irma.JwtDecode(commitments.ProofPjwt, &msg))
+		proofP = msg.ProofP
+	}
+
+	sigs := []*gabi.IssueSignatureMessage{}
+	for i, credreq := range request.Credentials {
+		issuer := credreq.CredentialTypeID.IssuerIdentifier()
+		sk, err := gabi.NewPrivateKeyFromFile(fmt.Sprintf("../testdata/irma_configuration/%s/%s/PrivateKeys/%d.xml",
+			issuer.SchemeManagerIdentifier().Name(), issuer.Name(), credreq.KeyCounter))
+		require.NoError(t, err)
+		pk, err := client.Configuration.PublicKey(issuer, credreq.KeyCounter)
+		require.NoError(t, err)
+		attrs, err := credreq.AttributeList(client.Configuration, version.Features().MetadataVersion)
+		require.NoError(t, err)
+		u := new(big.Int).Set(proofs[i].(*gabi.ProofU).U)
+		if proofP != nil && client.Configuration.SchemeManagers[issuer.SchemeManagerIdentifier()].Distributed() {
+			u.Mul(u, proofP.P).Mod(u, pk.N)
+		}
+		sig, err := gabi.NewIssuer(sk, pk, request.Context).IssueSignature(u, attrs.Ints, commitments.Nonce2)
+		require.NoError(t, err)
+		sigs = append(sigs, sig)
+	}
+	bts, err = json.Marshal(sigs)
+	require.NoError(t, err)
+	require.NoError(t, session.ReceiveSignatures(string(bts)))
+	return session, string(bts)
+}
+
+// Test a manual issuance session, in which we act as the issuer
+func TestManualIssuanceSession(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := getIssuanceRequest(true)
+	h := manualResultHandler{TestHandler{t, make(chan *irma.SessionError, 1), client}, make(chan string, 1)}
+	session, sigs := issueManually(t, client, request, h)
+	require.NotEmpty(t, client.Attributes(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0))
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.NotEmpty(t, logs)
+	require.Equal(t, irma.ActionIssuing, logs[len(logs)-1].Type)
+	require.Len(t, logs[len(logs)-1].Received, len(request.Credentials))
+
+	// The signatures have been consumed, and the handler is not called again
+	require.Error(t, session.ReceiveSignatures(sigs))
+	select {
+	case <-h.result:
+		t.Fatal("Success called more than once")
+	case err := <-h.c:
+		t.Fatal(err)
+	default:
+	}
+}
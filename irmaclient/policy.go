@@ -0,0 +1,226 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the disclosure policy of a Client: a list of rules with which
+// session requests can be approved or denied automatically, without asking the user.
+// If no rule matches a session request, or if the first matching rule says so,
+// permission is asked of the user through the Handler as usual.
+
+// PolicyDecision is the decision that a PolicyRule makes on a session request.
+type PolicyDecision string
+
+// Possible policy decisions
+const (
+	PolicyApprove = PolicyDecision("approve") // Perform the session without asking the user
+	PolicyDeny    = PolicyDecision("deny")    // Refuse the session without asking the user
+	PolicyAsk     = PolicyDecision("ask")     // Ask the user for permission
+)
+
+// PolicyRule is a rule of the disclosure policy. It matches a session request if
+// each of the following holds:
+//   - Server is empty, or equal to the host (and port, if any) of the IRMA server of the session;
+//   - Requestor is empty, or equal to the name of the requestor;
+//   - Actions contains the action of the session, or is empty and the session is a disclosure
+//     session; rules that do not approve also match any other action if Actions is empty;
+//   - if the rule approves: each requested attribute disjunction can be satisfied by one of our
+//     attributes whose type is contained in Attributes (or any attribute, if Attributes is empty),
+//     and whose value equals the one in Values, if Values contains its type;
+//   - if the rule denies or asks: Attributes and Values are empty, or any requested attribute
+//     disjunction can be satisfied by one of our attributes whose type is contained in Attributes
+//     or Values, and whose value equals the one in Values, if Values contains its type.
+//
+// So an approving rule must cover the entire request, while a denying rule matches as soon as
+// the request touches any of its attributes, no matter what else is requested along with it.
+// Issuance and signature sessions are approved only by rules that list their action explicitly.
+//
+// The server of a session is known only if the session runs over HTTPS, so that the server
+// is authenticated by TLS; rules with a Server never match other sessions. The requestor name
+// on the other hand is chosen by the server without being authenticated, so rules that match
+// on Requestor must also match on Server.
+type PolicyRule struct {
+	Name       string
+	Server     string                                  `json:",omitempty"`
+	Requestor  string                                  `json:",omitempty"`
+	Actions    []irma.Action                           `json:",omitempty"`
+	Attributes []irma.AttributeTypeIdentifier          `json:",omitempty"`
+	Values     map[irma.AttributeTypeIdentifier]string `json:",omitempty"`
+	Decision   PolicyDecision
+}
+
+// Policy returns a copy of the rules of the disclosure policy of this client, in the order
+// in which they are evaluated. Changing them does not affect the policy; use SetPolicy for that.
+func (client *Client) Policy() []*PolicyRule {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return copyPolicy(client.policy)
+}
+
+// SetPolicy replaces the rules of the disclosure policy of this client.
+// When a session request comes in, the first rule that matches it decides.
+func (client *Client) SetPolicy(rules []*PolicyRule) error {
+	for _, rule := range rules {
+		switch rule.Decision {
+		case PolicyApprove, PolicyDeny, PolicyAsk: // nop
+		default:
+			return errors.Errorf("Policy rule %s has invalid decision %s", rule.Name, rule.Decision)
+		}
+		if rule.Requestor != "" && rule.Server == "" {
+			return errors.Errorf("Policy rule %s matches on requestor name but not on server", rule.Name)
+		}
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.policy = copyPolicy(rules)
+	return client.storage.StorePolicy(client.policy)
+}
+
+// copyPolicy returns a deep copy of the rules, so that the caller can't change our policy
+// without going through SetPolicy.
+func copyPolicy(rules []*PolicyRule) []*PolicyRule {
+	if rules == nil {
+		return nil
+	}
+	copies := make([]*PolicyRule, len(rules))
+	for i, rule := range rules {
+		c := *rule
+		c.Actions = append([]irma.Action(nil), rule.Actions...)
+		c.Attributes = append([]irma.AttributeTypeIdentifier(nil), rule.Attributes...)
+		if rule.Values != nil {
+			c.Values = make(map[irma.AttributeTypeIdentifier]string, len(rule.Values))
+			for typ, val := range rule.Values {
+				c.Values[typ] = val
+			}
+		}
+		copies[i] = &c
+	}
+	return copies
+}
+
+// evaluatePolicy returns the first rule of our policy that matches a session of the
+// specified type with the specified (authenticated) server and requestor, in which one of
+// the attributes from each of the candidate lists is to be disclosed. The server must be
+// empty if it is not authenticated. If the rule approves the session, the returned
+// disclosure choice contains the attributes that satisfy the rule.
+// If no rule matches, nil is returned.
+func (client *Client) evaluatePolicy(
+	action irma.Action, server, requestor string, candidates [][]*irma.AttributeIdentifier,
+) (*PolicyRule, *irma.DisclosureChoice) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for _, rule := range client.policy {
+		if choice := client.matchRule(rule, action, server, requestor, candidates); choice != nil {
+			return rule, choice
+		}
+	}
+	return nil, nil
+}
+
+func (client *Client) matchRule(
+	rule *PolicyRule, action irma.Action, server, requestor string, candidates [][]*irma.AttributeIdentifier,
+) *irma.DisclosureChoice {
+	if rule.Server != "" && rule.Server != server {
+		return nil
+	}
+	// Requestor names are not authenticated, so rules without a server never match on them
+	if rule.Requestor != "" && (rule.Server == "" || rule.Requestor != requestor) {
+		return nil
+	}
+	if len(rule.Actions) > 0 {
+		found := false
+		for _, a := range rule.Actions {
+			if a == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	} else if rule.Decision == PolicyApprove && action != irma.ActionDisclosing {
+		return nil
+	}
+
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	if rule.Decision != PolicyApprove {
+		if client.ruleTouches(rule, candidates) {
+			return choice
+		}
+		return nil
+	}
+	for _, list := range candidates {
+		var chosen *irma.AttributeIdentifier
+		for _, candidate := range list {
+			if client.ruleAllows(rule, candidate) {
+				chosen = candidate
+				break
+			}
+		}
+		if chosen == nil {
+			return nil
+		}
+		choice.Attributes = append(choice.Attributes, chosen)
+	}
+	return choice
+}
+
+// ruleTouches returns whether or not any of the candidates is one of the attributes of the rule,
+// i.e., has a type contained in Attributes or Values that the rule allows. Rules without
+// Attributes and Values touch any request.
+func (client *Client) ruleTouches(rule *PolicyRule, candidates [][]*irma.AttributeIdentifier) bool {
+	if len(rule.Attributes) == 0 && len(rule.Values) == 0 {
+		return true
+	}
+	for _, list := range candidates {
+		for _, candidate := range list {
+			if !client.ruleAllows(rule, candidate) {
+				continue
+			}
+			if _, present := rule.Values[candidate.Type]; present {
+				return true
+			}
+			for _, typ := range rule.Attributes {
+				if typ == candidate.Type {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ruleAllows returns whether or not the specified attribute may be disclosed according to the rule.
+func (client *Client) ruleAllows(rule *PolicyRule, attr *irma.AttributeIdentifier) bool {
+	if len(rule.Attributes) > 0 {
+		found := false
+		for _, typ := range rule.Attributes {
+			if typ == attr.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	required, present := rule.Values[attr.Type]
+	if !present {
+		return true
+	}
+	if attr.Type.IsCredential() {
+		return false
+	}
+	for _, attrs := range client.attrs(attr.Type.CredentialTypeIdentifier()) {
+		if attrs.Hash() != attr.CredentialHash {
+			continue
+		}
+		val := attrs.UntranslatedAttribute(attr.Type)
+		return val != nil && client.Configuration.AttributeValuesEqual(attr.Type, *val, required)
+	}
+	return false
+}
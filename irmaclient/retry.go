@@ -0,0 +1,113 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the retrying of sending our response to the server at the end of an
+// interactive session. Computing the response (especially when a keyshare server is involved)
+// is expensive and requires user interaction, so if the network drops at that moment we keep
+// the response and send it again with exponential backoff, as long as the session at the
+// server is still waiting for it. The handler is informed of this as follows:
+//   - when a retry is pending, with a StatusRetryPending status update;
+//   - when the retry is being performed, with a StatusCommunicating status update,
+//     and afterwards with Success() as usual if it succeeded;
+//   - when the retrying is given up, with a Failure() of type ErrorRetryAbandoned.
+//
+// If the server session turns out to be done, then the server did receive our response and only
+// its reply to us got lost. In disclosure and signature sessions that reply is just the proof
+// status, which the requestor obtains from the server anyway, so the session succeeded. In
+// issuance sessions it contains the signatures on our new credentials, so the session failed.
+//
+// Pending retries are kept only in memory: if the app is killed or restarted before the
+// response could be delivered, the response and thereby the session are lost.
+
+// ResponseRetryAttempts is the amount of times that sending our response to the server is retried.
+var ResponseRetryAttempts = 5
+
+// ResponseRetryBackoff is the time that we wait before the first retry of sending our response
+// to the server. The wait doubles with each subsequent retry.
+var ResponseRetryBackoff = 2 * time.Second
+
+// postResponse posts our response to the specified url at the server, retrying if the
+// server could not be reached. If it returns false then the session has been aborted,
+// of which the handler has been informed. If it returns true without having received the
+// reply of the server into result, then the server received our response in a disclosure
+// or signature session but its reply got lost; result is then left untouched.
+func (session *session) postResponse(url string, result interface{}, message interface{}) bool {
+	err := session.post(url, result, message)
+	if err == nil {
+		return true
+	}
+	if !err.Temporary() {
+		session.fail(err)
+		return false
+	}
+
+	backoff := ResponseRetryBackoff
+	for attempt := 0; attempt < ResponseRetryAttempts; attempt++ {
+		session.Handler.StatusUpdate(session.Action, irma.StatusRetryPending)
+		select {
+		case <-time.After(backoff):
+		case <-session.finished:
+			return false // Dismissed or aborted by the context, which has already been reported
+		}
+		backoff *= 2
+
+		status, statusErr := session.serverSessionStatus()
+		if statusErr != nil {
+			if !statusErr.Temporary() {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorRetryAbandoned, Err: err,
+					Info: "could not retrieve server session status"})
+				return false
+			}
+			err = statusErr
+			continue // The server is still unreachable
+		}
+		switch status {
+		case serverStatusInitialized, serverStatusConnected: // still waiting for our response, retry
+		case serverStatusDone:
+			if session.Action != irma.ActionIssuing {
+				return true
+			}
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorRetryAbandoned, Err: err,
+				Info: "server received our response, but its reply containing our signatures was lost"})
+			return false
+		default:
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorRetryAbandoned, Err: err,
+				Info: "server session is no longer waiting for our response"})
+			return false
+		}
+
+		session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+		if err = session.post(url, result, message); err == nil {
+			return true
+		}
+		if !err.Temporary() {
+			session.fail(err)
+			return false
+		}
+	}
+
+	session.fail(&irma.SessionError{ErrorType: irma.ErrorRetryAbandoned, Err: err,
+		Info: "server could not be reached"})
+	return false
+}
+
+func (session *session) post(url string, result interface{}, message interface{}) *irma.SessionError {
+	if err := session.transport.Post(url, result, message); err != nil {
+		return err.(*irma.SessionError)
+	}
+	return nil
+}
+
+// serverSessionStatus returns the status of the session at the server.
+func (session *session) serverSessionStatus() (serverStatus, *irma.SessionError) {
+	var status serverStatus
+	if err := session.transport.Get("status", &status); err != nil {
+		return "", err.(*irma.SessionError)
+	}
+	return status, nil
+}
@@ -0,0 +1,120 @@
+package irmaclient
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the watching of the status of the session at the server during an
+// interactive session, so that we notice when the server cancels the session or it times out
+// while the user is still deciding, instead of only when we send our response. We subscribe to
+// the status using server-sent events if the server offers them; otherwise we poll its status
+// endpoint, which the server may hold until the status changes (i.e. long-polling).
+// This requires a transport that can perform these requests independently of the requests of
+// the session itself, such as irma.HTTPTransport; over other transports, e.g. a
+// irma.MessageTransport which performs one request at a time, the status is not watched.
+// When the server session is cancelled, the handler receives Cancelled(); when it times out,
+// the handler receives a Failure() of type irma.ErrorTimeout.
+
+// WatchServerStatus determines whether or not interactive sessions watch the status of the
+// session at the server.
+var WatchServerStatus = true
+
+// ServerStatusPollInterval is the minimum time between requests for the status of the session
+// at the server, when the server does not offer server-sent events.
+var ServerStatusPollInterval = 3 * time.Second
+
+// Statuses of server sessions, as returned by their status endpoint
+const (
+	serverStatusInitialized = serverStatus("INITIALIZED")
+	serverStatusConnected   = serverStatus("CONNECTED")
+	serverStatusCancelled   = serverStatus("CANCELLED")
+	serverStatusTimeout     = serverStatus("TIMEOUT")
+	serverStatusDone        = serverStatus("DONE")
+)
+
+type serverStatus string
+
+// statusTransport is implemented by session transports that can request the status of the
+// session at the server using their own context, such as irma.HTTPTransport.
+type statusTransport interface {
+	GetEvents(ctx context.Context, url string, handler func(data string) bool) error
+	GetContext(ctx context.Context, url string, result interface{}) error
+}
+
+// watchServerStatus follows the status of the session at the server until the session
+// is finished, aborting the session if the server session is cancelled or times out.
+func (session *session) watchServerStatus() {
+	defer session.panicFailure()
+	transport, ok := session.transport.(statusTransport)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(session.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.finished:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	subscribed := false
+	err := transport.GetEvents(ctx, "statusevents", func(data string) bool {
+		subscribed = true
+		return session.handleServerStatus(serverStatus(strings.Trim(strings.TrimSpace(data), `"`)))
+	})
+	if subscribed || ctx.Err() != nil {
+		return
+	}
+	fields := irma.LogFields{"reason": "no events received"}
+	if err != nil {
+		fields = irma.LogFields{"error": err.Error()}
+	}
+	session.client.Configuration.Log(irma.LogLevelDebug, "session.statusEventsUnavailable", fields)
+
+	session.pollServerStatus(ctx, transport)
+}
+
+// pollServerStatus repeatedly requests the status of the session at the server,
+// at most once every ServerStatusPollInterval, until it does not matter anymore.
+func (session *session) pollServerStatus(ctx context.Context, transport statusTransport) {
+	for {
+		start := time.Now()
+		var status serverStatus
+		if err := transport.GetContext(ctx, "status", &status); err != nil {
+			if serr, ok := err.(*irma.SessionError); !ok || !serr.Temporary() {
+				return // The server does not tell, or the session is being aborted
+			}
+		} else if !session.handleServerStatus(status) {
+			return
+		}
+		select {
+		case <-time.After(ServerStatusPollInterval - time.Since(start)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleServerStatus aborts the session if the server session has been cancelled or timed out,
+// returning whether or not the server status is still of interest.
+func (session *session) handleServerStatus(status serverStatus) bool {
+	switch status {
+	case serverStatusCancelled:
+		session.cancel()
+		return false
+	case serverStatusTimeout:
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorTimeout, Info: "server session timed out"})
+		return false
+	case serverStatusDone:
+		return false
+	default:
+		return true
+	}
+}
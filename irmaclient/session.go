@@ -1,11 +1,13 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"sort"
-	"strconv"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"math/big"
 
@@ -50,15 +52,6 @@ type SessionDismisser interface {
 	Dismiss()
 }
 
-// getMetadataVersion maps a chosen protocol version to a metadata version that
-// the server will use.
-func getMetadataVersion(v *irma.ProtocolVersion) byte {
-	if v.Below(2, 3) {
-		return 0x02 // no support for optional attributes
-	}
-	return 0x03 // current version
-}
-
 type session struct {
 	Action  irma.Action
 	Handler Handler
@@ -68,60 +61,46 @@ type session struct {
 	client      *Client
 	downloaded  *irma.IrmaIdentifierSet
 	irmaSession irma.IrmaSession
+	state       *issuanceState // In case of issuance sessions
+	commitments interface{}    // Commitments of a manual issuance session awaiting signatures, guarded by doneLock
 	done        bool
+	doneLock    sync.Mutex
+	finished    chan struct{} // Closed when the session is done
+	ctx         context.Context
+	rule        *PolicyRule // The policy rule that decided on this session, if any
+	// Values of the disclosed attributes that our credentials contain as hash
+	preimages map[irma.AttributeTypeIdentifier]string
+
+	// Copies of our keyshare server registrations used in the keyshare protocol, if any
+	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer
 
 	// These are empty on manual sessions
 	ServerURL string
 	info      *irma.SessionInfo
 	jwt       irma.RequestorJwt
-	transport *irma.HTTPTransport
+	transport irma.SessionTransport
 }
 
 // We implement the handler for the keyshare protocol
 var _ keyshareSessionHandler = (*session)(nil)
 
-// Supported protocol versions. Minor version numbers should be reverse sorted.
-var supportedVersions = map[int][]int{
-	2: {3, 2, 1},
-}
-
+// calcVersion returns the highest protocol version supported by both us and the server.
 func calcVersion(qr *irma.Qr) (*irma.ProtocolVersion, error) {
-	// Parse range supported by server
-	var minmajor, minminor, maxmajor, maxminor int
-	var err error
-	if minmajor, err = strconv.Atoi(string(qr.ProtocolVersion[0])); err != nil {
-		return nil, err
-	}
-	if minminor, err = strconv.Atoi(string(qr.ProtocolVersion[2])); err != nil {
-		return nil, err
-	}
-	if maxmajor, err = strconv.Atoi(string(qr.ProtocolMaxVersion[0])); err != nil {
-		return nil, err
-	}
-	if maxminor, err = strconv.Atoi(string(qr.ProtocolMaxVersion[2])); err != nil {
+	serverRange, err := irma.ParseProtocolVersionRange(qr.ProtocolVersion, qr.ProtocolMaxVersion)
+	if err != nil {
 		return nil, err
 	}
-
-	// Iterate supportedVersions in reverse sorted order (i.e. biggest major number first)
-	keys := make([]int, 0, len(supportedVersions))
-	for k := range supportedVersions {
-		keys = append(keys, k)
-	}
-	sort.Sort(sort.Reverse(sort.IntSlice(keys)))
-	for _, major := range keys {
-		for _, minor := range supportedVersions[major] {
-			aboveMinimum := major > minmajor || (major == minmajor && minor >= minminor)
-			underMaximum := major < maxmajor || (major == maxmajor && minor <= maxminor)
-			if aboveMinimum && underMaximum {
-				return irma.NewVersion(major, minor), nil
-			}
+	if common := serverRange.Intersect(irma.SupportedVersionRange()); common != nil {
+		if version := common.HighestSupported(); version != nil {
+			return version, nil
 		}
 	}
-	return nil, fmt.Errorf("No supported protocol version between %s and %s", qr.ProtocolVersion, qr.ProtocolMaxVersion)
+	return nil, errors.Errorf("No supported protocol version in %s, supported are %s",
+		serverRange, irma.SupportedVersionRange())
 }
 
 func (session *session) IsInteractive() bool {
-	return session.ServerURL != ""
+	return session.transport != nil
 }
 
 func (session *session) getBuilders() (gabi.ProofBuilderList, error) {
@@ -134,7 +113,7 @@ func (session *session) getBuilders() (gabi.ProofBuilderList, error) {
 	case irma.ActionDisclosing:
 		builders, err = session.client.ProofBuilders(session.choice)
 	case irma.ActionIssuing:
-		builders, err = session.client.IssuanceProofBuilders(session.irmaSession.(*irma.IssuanceRequest))
+		builders, session.state, err = session.client.issuanceProofBuilders(session.irmaSession.(*irma.IssuanceRequest))
 	}
 
 	return builders, err
@@ -150,7 +129,7 @@ func (session *session) getProof() (interface{}, error) {
 	case irma.ActionDisclosing:
 		message, err = session.client.Proofs(session.choice, session.irmaSession, false)
 	case irma.ActionIssuing:
-		message, err = session.client.IssueCommitments(session.irmaSession.(*irma.IssuanceRequest))
+		message, session.state, err = session.client.issueCommitments(session.irmaSession.(*irma.IssuanceRequest))
 	}
 
 	return message, err
@@ -166,7 +145,9 @@ func (session *session) checkKeyshareEnrollment() bool {
 			return false
 		}
 		distributed := manager.Distributed()
+		session.client.lock.Lock()
 		_, enrolled := session.client.keyshareServers[id]
+		session.client.lock.Unlock()
 		if distributed && !enrolled {
 			session.Handler.KeyshareEnrollmentMissing(id)
 			return false
@@ -209,66 +190,148 @@ func (session *session) checkAndUpateConfiguration() bool {
 	}
 
 	// Download missing credential types/issuers/public keys from the scheme manager
-	if session.downloaded, err = session.client.Configuration.Download(session.irmaSession.Identifiers()); err != nil {
+	session.client.lock.Lock()
+	session.downloaded, err = session.client.Configuration.Download(session.irmaSession.Identifiers())
+	session.client.lock.Unlock()
+	if err != nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 		return false
 	}
 	return true
 }
 
+// ManualSession is a session that is not performed with an IRMA server, but of which the
+// request is received and the response is sent by other means, e.g. over email, NFC or files.
+type ManualSession interface {
+	SessionDismisser
+
+	// ReceiveSignatures completes the second step of a manual issuance session: given
+	// the issuer's signatures over the commitments that were passed to Handler.Success(),
+	// it constructs and stores the new credentials. The handler is not called again; instead
+	// an error is returned if the credentials could not be constructed.
+	ReceiveSignatures(signaturesJSONString string) error
+}
+
 // NewManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
 func (client *Client) NewManualSession(sigrequestJSONString string, handler Handler) {
-	var err error
-	sigrequest := &irma.SignatureRequest{}
-	if err = json.Unmarshal([]byte(sigrequestJSONString), sigrequest); err != nil {
-		handler.Failure(irma.ActionUnknown, &irma.SessionError{Err: err})
-		return
+	client.NewManualSessionFor(irma.ActionSigning, irma.NewVersion(2, 0), "E-mail request", sigrequestJSONString, handler)
+}
+
+// NewManualSessionFor starts a manual session of the specified type and protocol version,
+// given a disclosure, signature or issuance request in JSON, a label with which to show the
+// requestor to the user, and a handler to pass messages to. When the session succeeds,
+// Handler.Success() receives the ProofList in JSON in case of disclosure and signature sessions.
+// Manual issuance sessions consist of two steps: first Handler.Success() receives the
+// commitments in JSON, which are to be sent to the issuer; then its signatures are to be
+// passed to ReceiveSignatures() of the returned ManualSession.
+func (client *Client) NewManualSessionFor(
+	action irma.Action, version *irma.ProtocolVersion, requestor string, requestJSONString string, handler Handler,
+) ManualSession {
+	var request irma.IrmaSession
+	switch action {
+	case irma.ActionDisclosing:
+		request = &irma.DisclosureRequest{}
+	case irma.ActionSigning:
+		request = &irma.SignatureRequest{}
+	case irma.ActionIssuing:
+		request = &irma.IssuanceRequest{}
+	default:
+		handler.Failure(action, &irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(action)})
+		return nil
 	}
+	if err := json.Unmarshal([]byte(requestJSONString), request); err != nil {
+		handler.Failure(action, &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return nil
+	}
+	request.SetVersion(version)
 
 	session := &session{
-		Action:      irma.ActionSigning, // TODO hardcoded for now
+		Action:      action,
 		Handler:     handler,
 		client:      client,
-		Version:     irma.NewVersion(2, 0), // TODO hardcoded for now
-		irmaSession: sigrequest,
+		Version:     version,
+		irmaSession: request,
+		ctx:         context.Background(),
 	}
 
 	session.Handler.StatusUpdate(session.Action, irma.StatusManualStarted)
+	session.processRequest(requestor)
+	return session
+}
 
-	if !session.checkAndUpateConfiguration() {
-		return
+// ReceiveSignatures implements ManualSession.
+func (session *session) ReceiveSignatures(signaturesJSONString string) error {
+	session.doneLock.Lock()
+	commitments := session.commitments
+	session.commitments = nil
+	session.doneLock.Unlock()
+	if commitments == nil {
+		return errors.New("No issuance commitments are awaiting signatures")
 	}
 
-	candidates, missing := session.client.CheckSatisfiability(session.irmaSession.ToDisclose())
-	if len(missing) > 0 {
-		session.Handler.UnsatisfiableRequest(session.Action, "E-mail request", missing)
-		// TODO: session.transport.Delete() on dialog cancel
-		return
+	response := []*gabi.IssueSignatureMessage{}
+	if err := json.Unmarshal([]byte(signaturesJSONString), &response); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse signatures", 0)
 	}
-	session.irmaSession.SetCandidates(candidates)
-
-	// Ask for permission to execute the session
-	callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
-		session.choice = choice
-		session.irmaSession.SetDisclosureChoice(choice)
-		go session.do(proceed)
-	})
-	session.Handler.RequestSignaturePermission(
-		*session.irmaSession.(*irma.SignatureRequest), "E-mail request", callback)
+	err := session.client.constructCredentials(response, session.irmaSession.(*irma.IssuanceRequest), session.state)
+	if err != nil {
+		return err
+	}
+	session.storeLogEntry(commitments)
+	session.client.handler.UpdateAttributes()
+	return nil
 }
 
 // NewSession creates and starts a new interactive IRMA session
 func (client *Client) NewSession(qr *irma.Qr, handler Handler) SessionDismisser {
+	return client.NewSessionContext(context.Background(), qr, handler)
+}
+
+// NewSessionContext creates and starts a new interactive IRMA session that is aborted
+// when the specified context is cancelled or its deadline is exceeded. In that case the
+// session is deleted at the server, and the handler is informed with a SessionError
+// of type irma.ErrorCancelled or irma.ErrorTimeout, respectively.
+func (client *Client) NewSessionContext(ctx context.Context, qr *irma.Qr, handler Handler) SessionDismisser {
+	events, controller := client.StartSessionContext(ctx, qr)
+	go dispatchSessionEvents(events, controller, handler)
+	return controller
+}
+
+// NewSessionTransport is like NewSessionContext(), but runs the session over the specified
+// transport instead of over HTTP with the server at the URL of the qr. This allows sessions
+// to run over other channels, see irma.SessionTransport. In scheme manager sessions
+// (irma.ActionSchemeManager), which do not involve a requestor, the transport is not used.
+func (client *Client) NewSessionTransport(
+	ctx context.Context, qr *irma.Qr, transport irma.SessionTransport, handler Handler,
+) SessionDismisser {
+	events, controller := client.StartSessionTransport(ctx, qr, transport)
+	go dispatchSessionEvents(events, controller, handler)
+	return controller
+}
+
+// newSession creates a new interactive IRMA session over the transport, or over HTTP if it
+// is nil, returning nil if it cannot be started (of which the handler is informed).
+// The session is started by begin().
+func (client *Client) newSession(
+	ctx context.Context, qr *irma.Qr, transport irma.SessionTransport, handler Handler,
+) *session {
+	if transport == nil {
+		httpTransport := irma.NewHTTPTransport(qr.URL)
+		httpTransport.SetLogger(client.Configuration.Logger)
+		transport = httpTransport
+	}
 	session := &session{
 		ServerURL: qr.URL,
-		transport: irma.NewHTTPTransport(qr.URL),
+		transport: transport,
 		Action:    irma.Action(qr.Type),
 		Handler:   handler,
 		client:    client,
+		finished:  make(chan struct{}),
+		ctx:       ctx,
 	}
+	session.transport.SetContext(ctx)
 
 	if session.Action == irma.ActionSchemeManager {
-		go session.managerSession()
 		return session
 	}
 
@@ -296,11 +359,21 @@ func (client *Client) NewSession(qr *irma.Qr, handler Handler) SessionDismisser
 		session.ServerURL += "/"
 	}
 
-	go session.start()
-
 	return session
 }
 
+// begin starts the session created by newSession().
+func (session *session) begin() {
+	if session.Action == irma.ActionSchemeManager {
+		go session.managerSession()
+		return
+	}
+	if session.ctx.Done() != nil {
+		go session.watchContext()
+	}
+	go session.start()
+}
+
 // start retrieves the first message in the IRMA protocol, checks if we can perform
 // the request, and informs the user of the outcome.
 func (session *session) start() {
@@ -334,6 +407,12 @@ func (session *session) start() {
 		}
 	}
 
+	session.processRequest(session.jwt.Requestor())
+}
+
+// processRequest checks if we can perform the session request, and if so, asks
+// permission of the user (or of our disclosure policy) to perform it.
+func (session *session) processRequest(requestor string) {
 	if !session.checkAndUpateConfiguration() {
 		return
 	}
@@ -341,18 +420,23 @@ func (session *session) start() {
 	if session.Action == irma.ActionIssuing {
 		ir := session.irmaSession.(*irma.IssuanceRequest)
 		for _, credreq := range ir.Credentials {
-			info, err := credreq.Info(session.client.Configuration, getMetadataVersion(session.Version))
+			info, err := credreq.Info(session.client.Configuration, session.Version.Features().MetadataVersion)
 			if err != nil {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownCredentialType, Err: err})
+				errtype := irma.ErrorUnknownCredentialType
+				if _, ok := err.(*irma.InvalidAttributeValueError); ok {
+					errtype = irma.ErrorInvalidAttributeValue
+				}
+				session.fail(&irma.SessionError{ErrorType: errtype, Err: err})
 				return
 			}
 			ir.CredentialInfoList = append(ir.CredentialInfoList, info)
 		}
 	}
 
-	candidates, missing := session.client.CheckSatisfiability(session.irmaSession.ToDisclose())
+	candidates, missing := session.client.checkSatisfiability(
+		session.irmaSession.ToDisclose(), preimagesSupported(session.irmaSession))
 	if len(missing) > 0 {
-		session.Handler.UnsatisfiableRequest(session.Action, session.jwt.Requestor(), missing)
+		session.Handler.UnsatisfiableRequest(session.Action, requestor, missing)
 		// TODO: session.transport.Delete() on dialog cancel
 		return
 	}
@@ -364,31 +448,111 @@ func (session *session) start() {
 		session.irmaSession.SetDisclosureChoice(choice)
 		go session.do(proceed)
 	})
-	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
+	if session.IsInteractive() {
+		session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
+		if WatchServerStatus {
+			go session.watchServerStatus()
+		}
+	}
+	session.requestPermission(requestor, candidates, callback)
+}
+
+// requestPermission decides on the session using the disclosure policy of the client
+// if it has a rule for this session, and asks the user for permission otherwise.
+func (session *session) requestPermission(
+	requestor string, candidates [][]*irma.AttributeIdentifier, callback PermissionHandler,
+) {
+	rule, choice := session.client.evaluatePolicy(session.Action, session.authenticatedServer(), requestor, candidates)
+	if rule != nil && rule.Decision != PolicyAsk {
+		session.rule = rule
+		if rule.Decision == PolicyDeny {
+			session.logDenial()
+		}
+		callback(rule.Decision == PolicyApprove, choice)
+		return
+	}
+
 	switch session.Action {
 	case irma.ActionDisclosing:
 		session.Handler.RequestVerificationPermission(
-			*session.irmaSession.(*irma.DisclosureRequest), session.jwt.Requestor(), callback)
+			*session.irmaSession.(*irma.DisclosureRequest), requestor, callback)
 	case irma.ActionSigning:
 		session.Handler.RequestSignaturePermission(
-			*session.irmaSession.(*irma.SignatureRequest), session.jwt.Requestor(), callback)
+			*session.irmaSession.(*irma.SignatureRequest), requestor, callback)
 	case irma.ActionIssuing:
 		session.Handler.RequestIssuancePermission(
-			*session.irmaSession.(*irma.IssuanceRequest), session.jwt.Requestor(), callback)
+			*session.irmaSession.(*irma.IssuanceRequest), requestor, callback)
 	default:
 		panic("Invalid session type") // does not happen, session.Action has been checked earlier
 	}
 }
 
+// authenticatedServer returns the host (and port, if any) of the IRMA server of the session
+// if the session runs over HTTPS, so that the server is authenticated by TLS, and "" otherwise.
+func (session *session) authenticatedServer() string {
+	transport, ok := session.transport.(*irma.HTTPTransport)
+	if !ok {
+		return ""
+	}
+	u, err := url.Parse(transport.Server)
+	if err != nil || u.Scheme != "https" {
+		return ""
+	}
+	return u.Host
+}
+
+// logDenial adds a log entry recording that our disclosure policy refused the session.
+func (session *session) logDenial() {
+	entry := &LogEntry{
+		Type:        session.Action,
+		Time:        irma.Timestamp(time.Now()),
+		SessionInfo: session.info,
+		PolicyRule:  session.rule.Name,
+		Denied:      true,
+	}
+	session.client.lock.Lock()
+	defer session.client.lock.Unlock()
+	if err := session.client.addLogEntry(entry); err != nil {
+		session.client.Configuration.Log(irma.LogLevelWarning, "policy.log", irma.LogFields{
+			"rule": session.rule.Name, "error": err.Error(),
+		})
+	}
+}
+
+// watchContext aborts the session when its context is done before the session is.
+func (session *session) watchContext() {
+	select {
+	case <-session.ctx.Done():
+		session.fail(irma.ContextError(session.ctx))
+	case <-session.finished:
+	}
+}
+
 func (session *session) do(proceed bool) {
 	defer session.panicFailure()
 
+	if session.ctx.Err() != nil || session.aborted() {
+		return // Already reported by watchContext() or watchServerStatus()
+	}
 	if !proceed {
 		session.cancel()
 		return
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
+	if !preimagesSupported(session.irmaSession) {
+		session.client.lock.Lock()
+		preimages := session.client.preimages(session.choice)
+		session.client.lock.Unlock()
+		if len(preimages) > 0 {
+			session.fail(&irma.SessionError{
+				ErrorType: irma.ErrorHashedAttribute,
+				Err:       errors.New("Attributes contained as hash cannot be disclosed using the protocol version of this session"),
+			})
+			return
+		}
+	}
+
 	if !session.irmaSession.Identifiers().Distributed(session.client.Configuration) {
 		message, err := session.getProof()
 		if err != nil {
@@ -400,15 +564,18 @@ func (session *session) do(proceed bool) {
 		builders, err := session.getBuilders()
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return
 		}
+		session.keyshareServers = session.client.sessionKeyshareServers()
 		startKeyshareSession(
+			session.ctx,
 			session,
 			session.Handler,
 			builders,
 			session.irmaSession,
 			session.client.Configuration,
-			session.client.keyshareServers,
-			session.client.state,
+			session.keyshareServers,
+			session.state,
 		)
 	}
 }
@@ -434,7 +601,7 @@ func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err
 	var ok bool
 	if serr, ok = err.(*irma.SessionError); !ok {
 		serr = &irma.SessionError{ErrorType: irma.ErrorKeyshare, Err: err}
-	} else {
+	} else if serr.ErrorType != irma.ErrorCancelled && serr.ErrorType != irma.ErrorTimeout {
 		serr.ErrorType = irma.ErrorKeyshare
 	}
 	session.fail(serr)
@@ -445,15 +612,31 @@ func (session *session) KeysharePin() {
 }
 
 func (session *session) KeysharePinOK() {
+	if err := session.client.storeKeyshareTokens(session.keyshareServers); err != nil {
+		// The session can proceed, but the PIN will be asked again in the next one
+		session.client.Configuration.Log(irma.LogLevelWarning, "keyshare.storeTokens", irma.LogFields{
+			"action": string(session.Action), "error": err.Error(),
+		})
+	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 }
 
 type disclosureResponse string
 
 func (session *session) sendResponse(message interface{}) {
-	var log *LogEntry
-	var err error
 	var messageJson []byte
+	var err error
+
+	// Our proofs are accompanied by the values of disclosed attributes contained as hash, if any
+	body := message
+	if session.Action == irma.ActionDisclosing || session.Action == irma.ActionSigning {
+		session.client.lock.Lock()
+		session.preimages = session.client.preimages(session.choice)
+		session.client.lock.Unlock()
+		if session.Version.Features().ProofsMessage {
+			body = &irma.ProofsMessage{Proofs: message.(gabi.ProofList), Preimages: session.preimages}
+		}
+	}
 
 	if session.IsInteractive() {
 		switch session.Action {
@@ -461,46 +644,72 @@ func (session *session) sendResponse(message interface{}) {
 			fallthrough
 		case irma.ActionDisclosing:
 			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, message); err != nil {
-				session.fail(err.(*irma.SessionError))
+			if !session.postResponse("proofs", &response, body) {
 				return
 			}
-			if response != "VALID" {
+			// The response is empty if the server received our proofs but its reply got lost
+			if response != "VALID" && response != "" {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)})
 				return
 			}
-			log, _ = session.createLogEntry(message.(gabi.ProofList)) // TODO err
 		case irma.ActionIssuing:
 			response := []*gabi.IssueSignatureMessage{}
-			if err = session.transport.Post("commitments", &response, message); err != nil {
-				session.fail(err.(*irma.SessionError))
+			if !session.postResponse("commitments", &response, message) {
 				return
 			}
-			if err = session.client.ConstructCredentials(response, session.irmaSession.(*irma.IssuanceRequest)); err != nil {
+			err = session.client.constructCredentials(response, session.irmaSession.(*irma.IssuanceRequest), session.state)
+			if err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 				return
 			}
-			log, _ = session.createLogEntry(message) // TODO err
 		}
 	} else {
-		messageJson, err = json.Marshal(message)
+		messageJson, err = json.Marshal(body)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
 			return
 		}
 	}
 
-	_ = session.client.addLogEntry(log) // TODO err
-	if !session.downloaded.Empty() {
+	// Manual issuance sessions are logged by ReceiveSignatures() once the issuer has responded
+	manualIssuance := session.Action == irma.ActionIssuing && !session.IsInteractive()
+	if !manualIssuance {
+		session.storeLogEntry(message)
+	}
+	if session.downloaded != nil && !session.downloaded.Empty() {
 		session.client.handler.UpdateConfiguration(session.downloaded)
 	}
-	if session.Action == irma.ActionIssuing {
+	if session.Action == irma.ActionIssuing && !manualIssuance {
 		session.client.handler.UpdateAttributes()
 	}
-	session.done = true
+
+	if !session.finish() {
+		return // The session was aborted in the meantime, which has already been reported
+	}
+	if manualIssuance {
+		session.doneLock.Lock()
+		session.commitments = message
+		session.doneLock.Unlock()
+	}
 	session.Handler.Success(session.Action, string(messageJson))
 }
 
+// storeLogEntry creates a log entry of the session with the specified response and stores it,
+// logging any failure to do so.
+func (session *session) storeLogEntry(response interface{}) {
+	log, err := session.createLogEntry(response)
+	if err == nil {
+		session.client.lock.Lock()
+		err = session.client.addLogEntry(log)
+		session.client.lock.Unlock()
+	}
+	if err != nil {
+		session.client.Configuration.Log(irma.LogLevelWarning, "session.log", irma.LogFields{
+			"action": string(session.Action), "error": err.Error(),
+		})
+	}
+}
+
 func (session *session) managerSession() {
 	defer func() {
 		if e := recover(); e != nil {
@@ -524,15 +733,18 @@ func (session *session) managerSession() {
 			session.Handler.Cancelled(session.Action) // No need to DELETE session here
 			return
 		}
-		if err := session.client.Configuration.InstallSchemeManager(manager); err != nil {
+		session.client.lock.Lock()
+		err := session.client.Configuration.InstallSchemeManager(manager)
+		if err == nil && manager.Distributed() {
+			session.client.UnenrolledSchemeManagers = session.client.unenrolledSchemeManagers()
+		}
+		session.client.lock.Unlock()
+		if err != nil {
 			session.Handler.Failure(session.Action, &irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 			return
 		}
 
-		// Update state and inform user of success
-		if manager.Distributed() {
-			session.client.UnenrolledSchemeManagers = session.client.unenrolledSchemeManagers()
-		}
+		// Inform user of success
 		session.client.handler.UpdateConfiguration(
 			&irma.IrmaIdentifierSet{
 				SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{manager.Identifier(): {}},
@@ -561,13 +773,33 @@ func panicToError(e interface{}) *irma.SessionError {
 	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info}
 }
 
+// aborted returns whether or not the session was aborted before the user finished deciding on it.
+func (session *session) aborted() bool {
+	session.doneLock.Lock()
+	defer session.doneLock.Unlock()
+	return session.done
+}
+
+// finish marks the session as done, returning false if it already was.
+func (session *session) finish() bool {
+	session.doneLock.Lock()
+	defer session.doneLock.Unlock()
+	if session.done {
+		return false
+	}
+	session.done = true
+	if session.finished != nil {
+		close(session.finished)
+	}
+	return true
+}
+
 // Idempotently send DELETE to remote server, returning whether or not we did something
 func (session *session) delete() bool {
-	if !session.done {
+	if session.finish() {
 		if session.IsInteractive() {
 			session.transport.Delete()
 		}
-		session.done = true
 		return true
 	}
 	return false
@@ -576,6 +808,9 @@ func (session *session) delete() bool {
 func (session *session) fail(err *irma.SessionError) {
 	if session.delete() {
 		err.Err = errors.Wrap(err.Err, 0)
+		session.client.Configuration.Log(irma.LogLevelWarning, "session.failure", irma.LogFields{
+			"action": string(session.Action), "type": string(err.ErrorType), "error": err.Error(),
+		})
 		if session.downloaded != nil && !session.downloaded.Empty() {
 			session.client.handler.UpdateConfiguration(session.downloaded)
 		}
@@ -599,6 +834,8 @@ func (session *session) Dismiss() {
 type issuanceState struct {
 	nonce2   *big.Int
 	builders []*gabi.CredentialBuilder
+	// Per builder, the commitment of its keyshare server to its part of our secret key, if any
+	commitments []*gabi.ProofPCommitment
 }
 
 func newIssuanceState() (*issuanceState, error) {
@@ -1,15 +1,22 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/require"
@@ -249,6 +256,76 @@ func TestLargeAttribute(t *testing.T) {
 	test.ClearTestStorage(t)
 }
 
+// Run issuance and disclosure sessions in parallel on the same client,
+// intended to be run with the race detector enabled (go test -race).
+func TestConcurrentSessions(t *testing.T) {
+	client := parseStorage(t)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	// require must only be used from the test goroutine, so we collect the errors
+	errs := make(chan error, 6)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- runSession(t, getIssuanceJwt("testip", false), "issue", client)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- runSession(t, getDisclosureJwt("testsp", id), "verification", client)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Each issuance session should have been logged, along with each disclosure session
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 6)
+	require.NotEmpty(t, client.CredentialInfoList())
+
+	test.ClearTestStorage(t)
+}
+
+// runSession performs a session like sessionHelper(), but returns any error instead of
+// failing the test, so that it can be used outside the test goroutine.
+func runSession(t *testing.T, jwtcontents interface{}, url string, client *Client) error {
+	qr, err := startApiSession(jwtcontents, url)
+	if err != nil {
+		return err
+	}
+
+	// Buffered, so that TestHandler.Failure() never falls back to t.Fatal()
+	c := make(chan *irma.SessionError, 2)
+	client.NewSession(qr, TestHandler{t, c, client})
+	if serr := <-c; serr != nil {
+		return serr
+	}
+	return nil
+}
+
+// startApiSession starts a session at the IRMA API server used in our tests, by posting
+// the request in an unsigned JWT, and returns the session pointer.
+func startApiSession(jwtcontents interface{}, url string) (*irma.Qr, error) {
+	url = "http://localhost:8088/irma_api_server/api/v2/" + url
+	//url = "https://demo.irmacard.org/tomcat/irma_api_server/api/v2/" + url
+
+	jwt, err := irma.UnsignedJwt(jwtcontents)
+	if err != nil {
+		return nil, err
+	}
+	qr, err := StartSession(jwt, url)
+	if err != nil {
+		return nil, err
+	}
+	qr.URL = url + "/" + qr.URL
+	return qr, nil
+}
+
 func sessionHelper(t *testing.T, jwtcontents interface{}, url string, client *Client) {
 	sessionHandlerHelper(t, jwtcontents, url, client, nil)
 }
@@ -259,21 +336,8 @@ func sessionHandlerHelper(t *testing.T, jwtcontents interface{}, url string, cli
 		client = parseStorage(t)
 	}
 
-	url = "http://localhost:8088/irma_api_server/api/v2/" + url
-	//url = "https://demo.irmacard.org/tomcat/irma_api_server/api/v2/" + url
-
-	headerbytes, err := json.Marshal(&map[string]string{"alg": "none", "typ": "JWT"})
+	qr, err := startApiSession(jwtcontents, url)
 	require.NoError(t, err)
-	bodybytes, err := json.Marshal(jwtcontents)
-	require.NoError(t, err)
-
-	jwt := base64.RawStdEncoding.EncodeToString(headerbytes) + "." + base64.RawStdEncoding.EncodeToString(bodybytes) + "."
-	qr, transportErr := StartSession(jwt, url)
-	if transportErr != nil {
-		fmt.Printf("+%v\n", transportErr)
-	}
-	require.NoError(t, transportErr)
-	qr.URL = url + "/" + qr.URL
 
 	c := make(chan *irma.SessionError)
 	if h == nil {
@@ -294,20 +358,82 @@ func enrollKeyshareServer(t *testing.T, client *Client) {
 	bytes := make([]byte, 8, 8)
 	rand.Read(bytes)
 	email := fmt.Sprintf("%s@example.com", hex.EncodeToString(bytes))
-	require.NoError(t, client.keyshareEnrollWorker(irma.NewSchemeManagerIdentifier("test"), email, "12345"))
+	require.NoError(t, client.keyshareEnrollWorker(irma.NewSchemeManagerIdentifier("test"), email, "12345", nil))
 }
 
-// Enroll at a keyshare server and do an issuance, disclosure,
-// and issuance session, also using irma-demo credentials deserialized from Android storage
+// Enroll at a keyshare server and do an issuance, disclosure, and signature session,
+// also using irma-demo credentials deserialized from Android storage
 func TestKeyshareEnrollmentAndSessions(t *testing.T) {
 	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+
+	removeKeyshareCredential(t, client)
+	require.NoError(t, client.KeyshareRemove(irma.NewSchemeManagerIdentifier("test")))
+	enrollKeyshareServer(t, client)
+	keyshareSessions(t, client)
+}
+
+// Use the existing keyshare enrollment and credentials deserialized from Android storage
+// in a keyshare session of each session type.
+func TestKeyshareSessions(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
 
+	removeKeyshareCredential(t, client)
+	keyshareSessions(t, client)
+}
+
+// Like TestKeyshareEnrollmentAndSessions, but with manual sessions in which the test acts as
+// issuer and verifier, so that this runs without IRMA API server.
+func TestKeyshareEnrollmentAndManualSessions(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+
+	removeKeyshareCredential(t, client)
+	require.NoError(t, client.KeyshareRemove(irma.NewSchemeManagerIdentifier("test")))
+	enrollKeyshareServer(t, client)
+	manualKeyshareSessions(t, client)
+}
+
+// Like TestKeyshareSessions, but with manual sessions in which the test acts as
+// issuer and verifier, so that this runs without IRMA API server.
+func TestKeyshareManualSessions(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+
+	removeKeyshareCredential(t, client)
+	manualKeyshareSessions(t, client)
+}
+
+// removeKeyshareCredential removes the test.test.mijnirma credential from Android storage, whose
+// keyshare secret is known only to the real keyshare server and not to the mock.
+func removeKeyshareCredential(t *testing.T, client *Client) {
 	require.NoError(t, client.RemoveCredentialByHash(
 		client.Attributes(irma.NewCredentialTypeIdentifier("test.test.mijnirma"), 0).Hash(),
 	))
-	require.NoError(t, client.KeyshareRemove(irma.NewSchemeManagerIdentifier("test")))
-	enrollKeyshareServer(t, client)
+}
+
+// issueKeyshareCredential issues a test.test.mijnirma credential in a manual session.
+func issueKeyshareCredential(t *testing.T, client *Client) {
+	expiry := irma.Timestamp(irma.NewMetadataAttribute(0).Expiry())
+	credid := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	request := &irma.IssuanceRequest{Credentials: []*irma.CredentialRequest{{
+		Validity:         &expiry,
+		CredentialTypeID: &credid,
+		Attributes:       map[string]string{"email": "example@example.com"},
+	}}}
+	c := make(chan *irma.SessionError, 1)
+	issueManually(t, client, request, manualResultHandler{TestHandler{t, c, client}, make(chan string, 1)})
+	require.NotNil(t, client.Attributes(credid, 0))
+}
 
+// keyshareSessions issues a test.test.mijnirma credential along with an irma-demo credential,
+// and discloses and signs with attributes from both, in sessions at the IRMA API server.
+func keyshareSessions(t *testing.T, client *Client) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	expiry := irma.Timestamp(irma.NewMetadataAttribute(0).Expiry())
 	credid := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
@@ -341,49 +467,576 @@ func TestKeyshareEnrollmentAndSessions(t *testing.T) {
 		},
 	)
 	sessionHelper(t, jwt, "signature", client)
-
-	test.ClearTestStorage(t)
 }
 
-// Use the existing keyshare enrollment and credentials deserialized from Android storage
-// in a keyshare session of each session type.
-// Use keyshareuser.sql to enroll the user at the keyshare server.
-func TestKeyshareSessions(t *testing.T) {
-	client := parseStorage(t)
+// manualKeyshareSessions issues a test.test.mijnirma credential in a manual session along with an
+// irma-demo credential, and discloses and signs with attributes from both.
+func manualKeyshareSessions(t *testing.T, client *Client) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
-
 	expiry := irma.Timestamp(irma.NewMetadataAttribute(0).Expiry())
 	credid := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
-	jwt := getCombinedJwt("testip", id)
-	jwt.(*irma.IdentityProviderJwt).Request.Request.Credentials = append(
-		jwt.(*irma.IdentityProviderJwt).Request.Request.Credentials,
-		&irma.CredentialRequest{
-			Validity:         &expiry,
-			CredentialTypeID: &credid,
-			Attributes:       map[string]string{"email": "example@example.com"},
-		},
-	)
-	sessionHelper(t, jwt, "issue", client)
+	request := getCombinedJwt("testip", id).(*irma.IdentityProviderJwt).Request.Request
+	request.Credentials = append(request.Credentials, &irma.CredentialRequest{
+		Validity:         &expiry,
+		CredentialTypeID: &credid,
+		Attributes:       map[string]string{"email": "example@example.com"},
+	})
+	c := make(chan *irma.SessionError, 1)
+	h := manualResultHandler{TestHandler{t, c, client}, make(chan string, 1)}
+	issueManually(t, client, request, h)
+	require.NotNil(t, client.Attributes(credid, 0))
 
-	jwt = getDisclosureJwt("testsp", id)
-	jwt.(*irma.ServiceProviderJwt).Request.Request.Content = append(
-		jwt.(*irma.ServiceProviderJwt).Request.Request.Content, //[]*AttributeDisjunction{},
-		&irma.AttributeDisjunction{
-			Label:      "foo",
-			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")},
-		},
-	)
-	sessionHelper(t, jwt, "verification", client)
+	content := `"content":[{"label":"foo","attributes":["irma-demo.RU.studentCard.studentID"]},` +
+		`{"label":"foo","attributes":["test.test.mijnirma.email"]}]`
+	session := client.NewManualSessionFor(irma.ActionDisclosing, irma.NewVersion(2, 3), "testsp",
+		`{"nonce":1,"context":1,`+content+`}`, h)
+	require.NotNil(t, session)
+	var result string
+	select {
+	case result = <-h.result:
+	case err := <-c:
+		t.Fatal(err)
+	}
+	proofs := gabi.ProofList{}
+	require.NoError(t, json.Unmarshal([]byte(result), &proofs))
+	require.Len(t, proofs, 2)
 
-	jwt = getSigningJwt("testsigclient", id)
-	jwt.(*irma.SignatureRequestorJwt).Request.Request.Content = append(
-		jwt.(*irma.SignatureRequestorJwt).Request.Request.Content, //[]*AttributeDisjunction{},
-		&irma.AttributeDisjunction{
-			Label:      "foo",
-			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")},
-		},
-	)
-	sessionHelper(t, jwt, "signature", client)
+	sigrequest := `{"nonce":1,"context":1,"message":"message","messageType":"STRING",` + content + `}`
+	session = client.NewManualSessionFor(irma.ActionSigning, irma.NewVersion(2, 3), "testsigclient", sigrequest, h)
+	require.NotNil(t, session)
+	select {
+	case result = <-h.result:
+	case err := <-c:
+		t.Fatal(err)
+	}
+	sigreq := &irma.SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(sigrequest), sigreq))
+	require.Equal(t, irma.VALID, irma.VerifySig(client.Configuration, result, sigreq).ProofStatus)
+}
 
-	test.ClearTestStorage(t)
+func TestSessionContextTimeout(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// A server that never answers our first message, but does accept the DELETE
+	deleted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted <- struct{}{}
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	qr := &irma.Qr{URL: server.URL, Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	c := make(chan *irma.SessionError, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	client.NewSessionContext(ctx, qr, TestHandler{t, c, client})
+	err := <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorTimeout, err.ErrorType)
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not deleted at the server")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	client.NewSessionContext(ctx, qr, TestHandler{t, c, client})
+	cancel()
+	err = <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorCancelled, err.ErrorType)
+}
+
+func TestSessionEvents(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// A session with a server that speaks no protocol version that we support fails
+	// immediately, after which the event channel is closed
+	qr := &irma.Qr{URL: "http://localhost:1", Type: irma.ActionDisclosing, ProtocolVersion: "1.0", ProtocolMaxVersion: "1.0"}
+	events, controller := client.StartSession(qr)
+	event := <-events
+	require.IsType(t, FailureEvent{}, event)
+	require.Equal(t, irma.ErrorProtocolVersionNotSupported, event.(FailureEvent).Err.ErrorType)
+	_, open := <-events
+	require.False(t, open)
+
+	// Nothing was requested, so there is nothing to answer
+	require.Error(t, controller.Permission(true, nil))
+	require.Error(t, controller.Pin(true, "12345"))
+	controller.Dismiss()
+
+	// A session that can't reach its server reports its status and then fails
+	qr = &irma.Qr{URL: "http://localhost:1", Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	events, _ = client.StartSession(qr)
+	var received []SessionEvent
+	for event := range events {
+		received = append(received, event)
+	}
+	require.Len(t, received, 2)
+	require.Equal(t, StatusEvent{Action: irma.ActionDisclosing, Status: irma.StatusCommunicating}, received[0])
+	require.Equal(t, irma.ErrorTransport, received[1].(FailureEvent).Err.ErrorType)
+
+	// A session requesting attributes that we don't have ends with an UnsatisfiableEvent,
+	// after which the event channel is closed as well
+	jwt, err := json.Marshal(getDisclosureJwt("testsp", irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")))
+	require.NoError(t, err)
+	deleted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/jwt":
+			info := irma.SessionInfo{Jwt: "e30." + base64.RawStdEncoding.EncodeToString(jwt) + ".", Nonce: big.NewInt(1), Context: big.NewInt(1)}
+			bts, _ := json.Marshal(info)
+			w.Write(bts)
+		case r.Method == http.MethodDelete:
+			deleted <- struct{}{}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	qr = &irma.Qr{URL: server.URL, Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	events, controller = client.StartSession(qr)
+	received = nil
+	for event := range events {
+		received = append(received, event)
+	}
+	require.IsType(t, UnsatisfiableEvent{}, received[len(received)-1])
+	controller.Dismiss()
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not deleted at the server")
+	}
+}
+
+type statusRecordingHandler struct {
+	TestHandler
+	statuses chan irma.Status
+}
+
+func (h statusRecordingHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.statuses <- status
+}
+
+// serverErrors collects the errors of the HTTP handlers of test servers. These run outside of
+// the test goroutine, so they must not fail the test themselves.
+type serverErrors chan error
+
+func newServerErrors() serverErrors {
+	return make(serverErrors, 10)
+}
+
+// ok records the error if it is not nil, returning whether or not it was nil.
+func (errs serverErrors) ok(err error) bool {
+	if err == nil {
+		return true
+	}
+	select {
+	case errs <- err:
+	default: // We already have errors enough to fail the test
+	}
+	return false
+}
+
+// requireNone fails the test if any of the handlers encountered an error.
+func (errs serverErrors) requireNone(t *testing.T) {
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestResponseRetry(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	defer func(backoff time.Duration) { ResponseRetryBackoff = backoff }(ResponseRetryBackoff)
+	ResponseRetryBackoff = 10 * time.Millisecond
+
+	// A server that drops the connection on our first response, and reports the specified
+	// status of the server session afterwards
+	var serverStatus string
+	var lock sync.Mutex
+	posts := 0
+	errs := newServerErrors()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == http.MethodPost && posts == 0:
+			posts++
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if errs.ok(err) {
+				errs.ok(conn.Close())
+			}
+		case r.Method == http.MethodPost:
+			posts++
+			w.Write([]byte(`"VALID"`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`"` + serverStatus + `"`))
+		}
+	}))
+	defer server.Close()
+	setServerStatus := func(status string) {
+		lock.Lock()
+		defer lock.Unlock()
+		serverStatus, posts = status, 0
+	}
+	requirePosts := func(expected int) {
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal(t, expected, posts)
+	}
+
+	newTestSession := func(handler Handler) *session {
+		return &session{
+			Action:    irma.ActionDisclosing,
+			Handler:   handler,
+			client:    client,
+			ServerURL: server.URL + "/",
+			transport: irma.NewHTTPTransport(server.URL),
+			finished:  make(chan struct{}),
+			ctx:       context.Background(),
+		}
+	}
+
+	// The server session is still waiting for our response, so the retry succeeds
+	setServerStatus("CONNECTED")
+	c := make(chan *irma.SessionError, 1)
+	statuses := make(chan irma.Status, 10)
+	var response disclosureResponse
+	require.True(t, newTestSession(statusRecordingHandler{TestHandler{t, c, client}, statuses}).
+		postResponse("proofs", &response, "proofs"))
+	require.Equal(t, disclosureResponse("VALID"), response)
+	require.Equal(t, irma.StatusRetryPending, <-statuses)
+	require.Equal(t, irma.StatusCommunicating, <-statuses)
+	requirePosts(2)
+
+	// The server session is gone, so retrying is abandoned
+	setServerStatus("CANCELLED")
+	require.False(t, newTestSession(statusRecordingHandler{TestHandler{t, c, client}, statuses}).
+		postResponse("proofs", &response, "proofs"))
+	require.Equal(t, irma.StatusRetryPending, <-statuses)
+	err := <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorRetryAbandoned, err.ErrorType)
+	requirePosts(1)
+
+	// The server session is done, so it received our response and only its reply got lost
+	setServerStatus("DONE")
+	response = ""
+	require.True(t, newTestSession(statusRecordingHandler{TestHandler{t, c, client}, statuses}).
+		postResponse("proofs", &response, "proofs"))
+	require.Equal(t, irma.StatusRetryPending, <-statuses)
+	require.Empty(t, response)
+	requirePosts(1)
+
+	// In issuance sessions that reply contains our signatures, without which the session failed
+	setServerStatus("DONE")
+	session := newTestSession(statusRecordingHandler{TestHandler{t, c, client}, statuses})
+	session.Action = irma.ActionIssuing
+	require.False(t, session.postResponse("commitments", &[]*gabi.IssueSignatureMessage{}, "commitments"))
+	require.Equal(t, irma.StatusRetryPending, <-statuses)
+	err = <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorRetryAbandoned, err.ErrorType)
+	requirePosts(1)
+	errs.requireNone(t)
+}
+
+func TestCalcVersion(t *testing.T) {
+	version, err := calcVersion(&irma.Qr{ProtocolVersion: "2.0", ProtocolMaxVersion: "2.2"})
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 2), version)
+
+	version, err = calcVersion(&irma.Qr{ProtocolVersion: "2.1", ProtocolMaxVersion: "10.1"})
+	require.NoError(t, err)
+	require.Equal(t, irma.SupportedProtocolVersions[0].Version, version)
+
+	_, err = calcVersion(&irma.Qr{ProtocolVersion: "2", ProtocolMaxVersion: "2.2"})
+	require.Error(t, err)
+	_, err = calcVersion(&irma.Qr{ProtocolVersion: "3.0", ProtocolMaxVersion: "3.1"})
+	require.Error(t, err)
+	_, err = calcVersion(&irma.Qr{ProtocolVersion: "2.3", ProtocolMaxVersion: "2.2"})
+	require.Error(t, err)
+
+	// Adding a protocol version to the supported versions suffices for it to be chosen
+	defer func(versions []irma.SupportedProtocolVersion) { irma.SupportedProtocolVersions = versions }(irma.SupportedProtocolVersions)
+	irma.SupportedProtocolVersions = append([]irma.SupportedProtocolVersion{
+		{Version: irma.NewVersion(3, 0), Features: irma.SupportedProtocolVersions[0].Features},
+	}, irma.SupportedProtocolVersions...)
+	version, err = calcVersion(&irma.Qr{ProtocolVersion: "2.1", ProtocolMaxVersion: "10.1"})
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(3, 0), version)
+	version, err = calcVersion(&irma.Qr{ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"})
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 3), version)
+}
+
+func unsignedJwt(t *testing.T, jwtcontents interface{}) string {
+	jwt, err := irma.UnsignedJwt(jwtcontents)
+	require.NoError(t, err)
+	return jwt
+}
+
+// Perform a disclosure session with an in-process requestor over a loopback transport.
+func TestLoopbackSession(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	attrs := client.attrs(studentID.CredentialTypeIdentifier())[0]
+	index, err := attrs.CredentialType().IndexOf(studentID)
+	require.NoError(t, err)
+
+	jwt := unsignedJwt(t, getDisclosureJwt("testsp", studentID))
+	var proofs []byte
+	errs := newServerErrors()
+	requestor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jwt":
+			info := &irma.SessionInfo{Jwt: jwt, Nonce: big.NewInt(42), Context: big.NewInt(1337)}
+			errs.ok(json.NewEncoder(w).Encode(info))
+		case "/proofs":
+			var err error
+			proofs, err = ioutil.ReadAll(r.Body)
+			errs.ok(err)
+			w.Write([]byte(`"VALID"`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	qr := &irma.Qr{Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	c := make(chan *irma.SessionError, 1)
+	h := pendingPermissionHandler{TestHandler{t, c, client}, make(chan PermissionHandler, 1)}
+
+	// Pretend that our credential contains the disclosed attribute as hash. Before protocol version
+	// 2.4 our response cannot carry its value, so it is refused when chosen...
+	client.NewSessionTransport(context.Background(), qr, irma.NewLoopbackTransport(requestor), h)
+	callback := <-h.callbacks
+	attrs.Preimages = map[int]string{index: "s1234567"}
+	callback(true, &irma.DisclosureChoice{
+		Attributes: []*irma.AttributeIdentifier{{Type: studentID, CredentialHash: attrs.Hash()}},
+	})
+	serr := <-c
+	require.NotNil(t, serr)
+	require.Equal(t, irma.ErrorHashedAttribute, serr.ErrorType)
+	require.Nil(t, proofs)
+
+	// ... and not offered as candidate
+	client.NewSessionTransport(context.Background(), qr, irma.NewLoopbackTransport(requestor), TestHandler{t, c, client})
+	serr = <-c
+	require.NotNil(t, serr)
+	require.Equal(t, irma.ErrorType("UnsatisfiableRequest"), serr.ErrorType)
+
+	qr.ProtocolMaxVersion = "2.4"
+	client.NewSessionTransport(context.Background(), qr, irma.NewLoopbackTransport(requestor), TestHandler{t, c, client})
+	if err := <-c; err != nil {
+		t.Fatal(*err)
+	}
+
+	// From protocol version 2.4 the proofs are sent along with the preimages
+	var message struct {
+		Proofs    json.RawMessage
+		Preimages map[irma.AttributeTypeIdentifier]string
+	}
+	require.NoError(t, json.Unmarshal(proofs, &message))
+	require.NotEmpty(t, message.Proofs)
+	require.Equal(t, map[irma.AttributeTypeIdentifier]string{studentID: "s1234567"}, message.Preimages)
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Equal(t, message.Preimages, logs[len(logs)-1].Preimages)
+	errs.requireNone(t)
+}
+
+// A handler that leaves the permission dialog open until the test answers it
+type pendingPermissionHandler struct {
+	TestHandler
+	callbacks chan PermissionHandler
+}
+
+func (h pendingPermissionHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName string, callback PermissionHandler) {
+	h.callbacks <- callback
+}
+
+// The server cancels or times out the session while the user is deciding on it.
+func TestServerStatus(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	defer func(interval time.Duration) { ServerStatusPollInterval = interval }(ServerStatusPollInterval)
+	ServerStatusPollInterval = 10 * time.Millisecond
+
+	jwt := unsignedJwt(t, getDisclosureJwt("testsp", irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	var lock sync.Mutex
+	var status string
+	var events bool
+	var proofs int
+	errs := newServerErrors()
+	requestor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/jwt":
+			info := &irma.SessionInfo{Jwt: jwt, Nonce: big.NewInt(42), Context: big.NewInt(1337)}
+			errs.ok(json.NewEncoder(w).Encode(info))
+		case "/status":
+			w.Write([]byte(`"` + status + `"`))
+		case "/statusevents":
+			if !events {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: \"CONNECTED\"\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte(": comment\ndata: \"" + status + "\"\n\n"))
+		case "/proofs":
+			proofs++
+			w.Write([]byte(`"VALID"`))
+		}
+	})
+	setStatus := func(s string) {
+		lock.Lock()
+		defer lock.Unlock()
+		status = s
+	}
+	getProofs := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return proofs
+	}
+
+	qr := &irma.Qr{Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	c := make(chan *irma.SessionError, 1)
+	h := pendingPermissionHandler{TestHandler{t, c, client}, make(chan PermissionHandler, 1)}
+
+	// The status is not watched over a message transport, whose requests would block our response
+	setStatus("CANCELLED")
+	client.NewSessionTransport(context.Background(), qr, irma.NewLoopbackTransport(requestor), h)
+	callback := <-h.callbacks
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, c)
+	callback(true, &irma.DisclosureChoice{})
+	require.Nil(t, <-c)
+	require.Equal(t, 1, getProofs())
+
+	// Polling the status over HTTP without server-sent events
+	setStatus("CONNECTED")
+	server := httptest.NewServer(requestor)
+	defer server.Close()
+	qr.URL = server.URL
+	client.NewSession(qr, h)
+	callback = <-h.callbacks
+	time.Sleep(50 * time.Millisecond) // The session is not aborted while the server waits
+	require.Empty(t, c)
+	setStatus("CANCELLED")
+	err := <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorType(""), err.ErrorType) // Cancelled() was called
+	callback(true, &irma.DisclosureChoice{})
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 1, getProofs())
+
+	// Server-sent events over HTTP
+	setStatus("TIMEOUT")
+	lock.Lock()
+	events = true
+	lock.Unlock()
+	client.NewSession(qr, h)
+	<-h.callbacks
+	err = <-c
+	require.NotNil(t, err)
+	require.Equal(t, irma.ErrorTimeout, err.ErrorType)
+	errs.requireNone(t)
+}
+
+// Enroll at the keyshare server, and change our PIN there.
+func TestKeyshareChangePin(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useMockKeyshareServer(t, client).Close()
+
+	manager := irma.NewSchemeManagerIdentifier("test")
+	require.NoError(t, client.KeyshareRemove(manager))
+	enrollKeyshareServer(t, client)
+
+	success, _, _, err := client.KeyshareChangePin(manager, "12345", "54321")
+	require.NoError(t, err)
+	require.True(t, success)
+
+	// The old PIN is no longer valid
+	success, tries, blocked, err := client.KeyshareChangePin(manager, "12345", "54321")
+	require.NoError(t, err)
+	require.False(t, success)
+	require.NotZero(t, tries)
+	require.Zero(t, blocked)
+
+	_, _, _, err = client.KeyshareChangePin(manager, "54321", "123")
+	require.Error(t, err)
+}
+
+// Enroll at the keyshare server, remove our account there, and enroll again.
+func TestKeyshareUnenroll(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	s := useMockKeyshareServer(t, client)
+	defer s.Close()
+
+	manager := irma.NewSchemeManagerIdentifier("test")
+	require.NoError(t, client.KeyshareRemove(manager))
+	enrollKeyshareServer(t, client)
+	key := client.keyshareServers[manager].PrivateKey
+
+	success, tries, _, err := client.KeyshareUnenroll(manager, "54321")
+	require.NoError(t, err)
+	require.False(t, success)
+	require.NotZero(t, tries)
+	require.Contains(t, client.keyshareServers, manager)
+
+	success, _, _, err = client.KeyshareUnenroll(manager, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NotContains(t, client.keyshareServers, manager)
+	require.Contains(t, client.UnenrolledSchemeManagers, manager)
+
+	_, _, _, err = client.KeyshareUnenroll(manager, "12345")
+	require.Error(t, err)
+
+	// Enroll again with the same Paillier key pair, as KeyshareReenroll() does
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	email := fmt.Sprintf("%s@example.com", hex.EncodeToString(bytes))
+	require.NoError(t, client.keyshareEnrollWorker(manager, email, "12345", key))
+	require.Equal(t, key, client.keyshareServers[manager].PrivateKey)
+
+	// Servers may respond to unregistering without body
+	s.UnregisterNoContent = true
+	success, _, _, err = client.KeyshareUnenroll(manager, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NotContains(t, client.keyshareServers, manager)
+
+	// If the keyshare server does not know us, we are already unenrolled there. Only then
+	// KeyshareReenroll() enrolls again using our local registration.
+	enrollKeyshareServer(t, client)
+	kss := client.keyshareServers[manager]
+	require.Error(t, client.checkKeyshareUnregistered(kss))
+	s.removeUser(kss)
+	require.NoError(t, client.checkKeyshareUnregistered(kss))
+	success, _, _, err = client.KeyshareUnenroll(manager, "12345")
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NotContains(t, client.keyshareServers, manager)
 }
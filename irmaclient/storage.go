@@ -28,6 +28,7 @@ const (
 	updatesFile     = "updates"
 	logsFile        = "logs"
 	preferencesFile = "preferences"
+	policyFile      = "policy"
 	signaturesDir   = "sigs"
 )
 
@@ -115,6 +116,10 @@ func (s *storage) StorePreferences(prefs Preferences) error {
 	return s.store(prefs, preferencesFile)
 }
 
+func (s *storage) StorePolicy(rules []*PolicyRule) error {
+	return s.store(rules, policyFile)
+}
+
 func (s *storage) StoreUpdates(updates []update) (err error) {
 	return s.store(updates, updatesFile)
 }
@@ -215,3 +220,11 @@ func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	return config, s.load(&config, preferencesFile)
 }
+
+func (s *storage) LoadPolicy() (rules []*PolicyRule, err error) {
+	rules = []*PolicyRule{}
+	if err := s.load(&rules, policyFile); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
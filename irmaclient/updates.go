@@ -115,6 +115,9 @@ func (client *Client) update() error {
 // and saving them to storage.
 // CAREFUL: this method overwrites any existing secret keys and attributes on storage.
 func (client *Client) ParseAndroidStorage() (present bool, err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	if client.androidStoragePath == "" {
 		return false, nil
 	}
@@ -166,7 +169,9 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 			if err = json.Unmarshal([]byte(jsontag), &keys); err != nil {
 				return
 			}
+			client.paillierKeyLock.Lock()
 			client.paillierKeyCache = keys[0]
+			client.paillierKeyLock.Unlock()
 		}
 	}
 
@@ -211,10 +216,13 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 	}
 	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
 
-	if err = client.storage.StorePaillierKeys(client.paillierKeyCache); err != nil {
+	client.paillierKeyLock.Lock()
+	cached := client.paillierKeyCache
+	client.paillierKeyLock.Unlock()
+	if err = client.storage.StorePaillierKeys(cached); err != nil {
 		return
 	}
-	if client.paillierKeyCache == nil {
+	if cached == nil {
 		client.paillierKey(false) // trigger calculating a new one
 	}
 	return
@@ -47,6 +47,10 @@ type Configuration struct {
 	// (i.e., invalid signature, parsing error), and the problem that occurred when parsing them
 	DisabledSchemeManagers map[SchemeManagerIdentifier]*SchemeManagerError
 
+	// Logger receives the log events of this instance, and of the transports it uses.
+	// If nil, DefaultLogger is used.
+	Logger Logger
+
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
 	reverseHashes map[string]CredentialTypeIdentifier
 	initialized   bool
@@ -136,6 +140,9 @@ func (conf *Configuration) ParseFolder() (err error) {
 		var ok bool
 		if mgrerr, ok = err.(*SchemeManagerError); ok {
 			conf.DisabledSchemeManagers[manager.Identifier()] = mgrerr
+			conf.Log(LogLevelWarning, "scheme.disabled", LogFields{
+				"scheme": manager.Identifier().String(), "status": string(mgrerr.Status), "error": mgrerr.Error(),
+			})
 			return nil
 		}
 		return err // Not a SchemeManagerError? return it & halt parsing now
@@ -515,7 +522,8 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager) error {
 		return err
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	conf.Log(LogLevelInfo, "scheme.install", LogFields{"scheme": name, "url": manager.URL})
+	t := conf.newTransport(manager.URL, manager.URLPins)
 	path := fmt.Sprintf("%s/%s", conf.Path, name)
 	if err := t.GetFile("description.xml", path+"/description.xml"); err != nil {
 		return err
@@ -537,7 +545,7 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager) error {
 // DownloadSchemeManagerSignature downloads, stores and verifies the latest version
 // of the index file and signature of the specified manager.
 func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager) (err error) {
-	t := NewHTTPTransport(manager.URL)
+	t := conf.newTransport(manager.URL, manager.URLPins)
 	path := fmt.Sprintf("%s/%s", conf.Path, manager.ID)
 	index := filepath.Join(path, "index")
 	sig := filepath.Join(path, "index.sig")
@@ -549,6 +557,7 @@ func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager
 
 	defer func() {
 		if err != nil {
+			conf.Log(LogLevelWarning, "scheme.signatureFailed", LogFields{"scheme": manager.ID, "error": err.Error()})
 			_ = conf.restoreManagerSignature(index, sig)
 		}
 	}()
@@ -822,7 +831,8 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 
 	issPattern := regexp.MustCompile("(.+)/(.+)/description\\.xml")
 	credPattern := regexp.MustCompile("(.+)/(.+)/Issues/(.+)/description\\.xml")
-	transport := NewHTTPTransport("")
+	transport := conf.newTransport("", manager.URLPins)
+	var updated int
 
 	// TODO: how to recover/fix local copy if err != nil below?
 	for filename, newHash := range newIndex {
@@ -845,6 +855,8 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		if err = transport.GetFile(manager.URL+"/"+stripped, path); err != nil {
 			return
 		}
+		conf.Log(LogLevelDebug, "scheme.download", LogFields{"scheme": manager.ID, "file": filename})
+		updated++
 		// See if the file is a credential type or issuer, and add it to the downloaded set if so
 		if downloaded == nil {
 			continue
@@ -863,5 +875,15 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	}
 
 	manager.index = newIndex
+	if updated > 0 {
+		conf.Log(LogLevelInfo, "scheme.update", LogFields{"scheme": manager.ID, "files": updated})
+	}
 	return
 }
+
+// newTransport returns a transport to the specified server, logging to the logger of this instance.
+func (conf *Configuration) newTransport(url string, pins []string) *HTTPTransport {
+	transport := NewPinnedHTTPTransport(url, pins)
+	transport.SetLogger(conf.Logger)
+	return transport
+}
@@ -1,15 +1,28 @@
 package irma
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/require"
@@ -201,6 +214,265 @@ func TestMetadataCompatibility(t *testing.T) {
 	require.Equal(t, 2, attr.KeyCounter(), "Unexpected key counter")
 }
 
+func TestAttributeValueTypes(t *testing.T) {
+	credtype := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+	<SchemeManager>irma-demo</SchemeManager>
+	<IssuerID>MijnOverheid</IssuerID>
+	<CredentialID>typed</CredentialID>
+	<Attributes>
+		<Attribute id="name"></Attribute>
+		<Attribute id="age" type="integer"></Attribute>
+		<Attribute id="birthdate" type="date"></Attribute>
+		<Attribute id="over18" type="boolean" optional="true"></Attribute>
+		<Attribute id="level" type="enum"><Values><Value>low</Value><Value>high</Value></Values></Attribute>
+		<Attribute id="photo" type="image" optional="true"></Attribute>
+		<Attribute id="future" type="geolocation"></Attribute>
+	</Attributes>
+</IssueSpecification>`), credtype))
+	conf, err := NewConfiguration("testdata/irma_configuration", "")
+	require.NoError(t, err)
+	credid := credtype.Identifier()
+	conf.CredentialTypes[credid] = credtype
+	conf.addReverseHash(credid)
+	conf.publicKeys[credid.IssuerIdentifier()] = map[int]*gabi.PublicKey{0: testPublicKey()}
+	id := func(name string) AttributeTypeIdentifier {
+		return NewAttributeTypeIdentifier("irma-demo.MijnOverheid.typed." + name)
+	}
+
+	require.Equal(t, AttributeValueString, conf.AttributeDescription(id("name")).ValueType())
+	require.Equal(t, AttributeValueString, conf.AttributeDescription(id("future")).ValueType())
+	require.Equal(t, []string{"low", "high"}, conf.AttributeDescription(id("level")).Values)
+	require.Nil(t, conf.AttributeDescription(id("nonexisting")))
+
+	// Values are validated at issuance
+	valid := map[string]string{"name": "Alice", "age": "42", "birthdate": "1976-02-29",
+		"level": "high", "future": "anything"}
+	for attr, invalid := range map[string]string{"age": "42.5", "birthdate": "1977-02-29",
+		"over18": "yes", "level": "medium", "photo": "not base64!"} {
+		request := &CredentialRequest{CredentialTypeID: &credid, Attributes: map[string]string{}}
+		for name, value := range valid {
+			request.Attributes[name] = value
+		}
+		request.Attributes[attr] = invalid
+		_, err = request.AttributeList(conf, 0x03)
+		require.Error(t, err, attr)
+	}
+
+	// Typed getters
+	request := &CredentialRequest{CredentialTypeID: &credid, Attributes: valid}
+	request.Attributes["photo"] = "iVBORw0KGgo="
+	list, err := request.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	age, err := list.IntegerAttribute(id("age"))
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(42), age)
+	birthdate, err := list.DateAttribute(id("birthdate"))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(1976, 2, 29, 0, 0, 0, 0, time.UTC), *birthdate)
+	over18, err := list.BooleanAttribute(id("over18"))
+	require.NoError(t, err)
+	require.Nil(t, over18)
+	photo, err := list.ImageAttribute(id("photo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("\x89PNG\r\n\x1a\n"), photo)
+	_, err = list.IntegerAttribute(id("birthdate"))
+	require.Error(t, err)
+
+	// Values are compared according to their type
+	require.True(t, conf.AttributeValuesEqual(id("age"), "42", "042"))
+	require.False(t, conf.AttributeValuesEqual(id("age"), "42", "43"))
+	require.False(t, conf.AttributeValuesEqual(id("name"), "42", "042"))
+	require.False(t, conf.AttributeValuesEqual(id("level"), "low", "high"))
+	require.True(t, conf.AttributeValuesEqual(NewAttributeTypeIdentifier("a.b.c.d"), "x", "x"))
+}
+
+// testPublicKey returns a public key having only a modulus of 1024 bits, which determines the attribute size.
+func testPublicKey() *gabi.PublicKey {
+	return &gabi.PublicKey{N: new(big.Int).SetBit(new(big.Int), 1023, 1)}
+}
+
+func TestAttributeEncoding(t *testing.T) {
+	size, err := AttributeSize(testPublicKey(), 0x04)
+	require.NoError(t, err)
+	_, err = AttributeSize(nil, 0x04)
+	require.Error(t, err)
+
+	short := strings.Repeat("a", size)
+	for _, version := range []byte{0x02, 0x03, 0x04} {
+		attr, hashed := encodeAttribute(short, version, size)
+		require.False(t, hashed)
+		decoded, err := decodeAttribute(attr, version, nil)
+		require.NoError(t, err)
+		require.Equal(t, short, *decoded)
+	}
+	decoded, err := decodeAttribute(big.NewInt(0), 0x04, nil)
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+
+	// Before metadata version 0x04 long values are encoded directly, exceeding the attribute size
+	attr, hashed := encodeAttribute(short+"a", 0x03, size)
+	require.False(t, hashed)
+	require.Equal(t, short+"a", string(new(big.Int).Rsh(attr, 1).Bytes()))
+
+	// From 0x04 they are hashed, and decoding requires the preimage
+	for _, value := range []string{short + "a", strings.Repeat("photo", 10000)} {
+		attr, hashed := encodeAttribute(value, 0x04, size)
+		require.True(t, hashed)
+		require.True(t, attr.BitLen() <= 256)
+		_, err = decodeAttribute(attr, 0x04, nil)
+		require.Equal(t, ErrorMissingPreimage, err)
+		other := value + "b"
+		_, err = decodeAttribute(attr, 0x04, &other)
+		require.Equal(t, ErrorInvalidPreimage, err)
+		decoded, err = decodeAttribute(attr, 0x04, &value)
+		require.NoError(t, err)
+		require.Equal(t, value, *decoded)
+	}
+}
+
+func TestLargeAttributeValues(t *testing.T) {
+	credtype := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+	<SchemeManager>irma-demo</SchemeManager>
+	<IssuerID>MijnOverheid</IssuerID>
+	<CredentialID>large</CredentialID>
+	<Attributes>
+		<Attribute id="address"></Attribute>
+		<Attribute id="photo" type="image"></Attribute>
+	</Attributes>
+</IssueSpecification>`), credtype))
+	conf, err := NewConfiguration("testdata/irma_configuration", "")
+	require.NoError(t, err)
+	logger := &recordingLogger{events: map[string][]LogFields{}}
+	conf.Logger = logger
+	credid := credtype.Identifier()
+	conf.CredentialTypes[credid] = credtype
+	conf.addReverseHash(credid)
+	conf.publicKeys[credid.IssuerIdentifier()] = map[int]*gabi.PublicKey{0: testPublicKey()}
+	address := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.large.address")
+	photo := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.large.photo")
+
+	size, err := AttributeSize(testPublicKey(), 0x04)
+	require.NoError(t, err)
+	values := map[string]string{
+		"address": "",
+		"photo":   base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 1000)),
+	}
+	if size > 0 {
+		values["address"] = strings.Repeat("x", size) // Fits exactly
+	}
+	request := &CredentialRequest{CredentialTypeID: &credid, Attributes: values}
+
+	// Before metadata version 0x04 too large values are refused
+	_, err = request.AttributeList(conf, 0x03)
+	require.IsType(t, &InvalidAttributeValueError{}, err)
+	require.Equal(t, "photo", err.(*InvalidAttributeValueError).Attribute)
+	oldSize, err := AttributeSize(testPublicKey(), 0x03)
+	require.NoError(t, err)
+	small := &CredentialRequest{CredentialTypeID: &credid, Attributes: map[string]string{
+		"address": strings.Repeat("x", oldSize), // Fits exactly
+		"photo":   "",
+	}}
+	list, err := small.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	require.Empty(t, list.Preimages)
+	small.Attributes["address"] += "x" // One byte too large
+	_, err = small.AttributeList(conf, 0x03)
+	require.IsType(t, &InvalidAttributeValueError{}, err)
+	require.Equal(t, "address", err.(*InvalidAttributeValueError).Attribute)
+
+	// From 0x04 they are hashed, with the value kept as preimage
+	list, err = request.AttributeList(conf, 0x04)
+	require.NoError(t, err)
+	require.Equal(t, map[int]string{1: values["photo"]}, list.Preimages)
+	require.Equal(t, values["address"], *list.UntranslatedAttribute(address))
+	require.Equal(t, values["photo"], *list.UntranslatedAttribute(photo))
+	require.Equal(t, values["photo"], list.Info().Attributes[1]["en"])
+	image, err := list.ImageAttribute(photo)
+	require.NoError(t, err)
+	require.Len(t, image, 4000)
+	require.Nil(t, NewAttributeListFromInts(list.Ints, conf).UntranslatedAttribute(photo))
+
+	// Verifiers check the preimage of disclosed hashed attributes
+	cred := NewDisclosedCredentialFromADisclosed(map[int]*big.Int{1: list.Ints[0], 2: list.Ints[1], 3: list.Ints[2]}, conf)
+	_, err = cred.AttributeValue(photo)
+	require.Equal(t, ErrorMissingPreimage, err)
+	satisfied, result := DisclosedCredentialList{cred}.isAttributeSatisfied(photo, nil, conf)
+	require.False(t, satisfied)
+	require.Equal(t, INVALID_VALUE, result.AttributeProofStatus)
+	require.Len(t, logger.events["verify.preimage"], 1)
+
+	cred.Preimages = map[AttributeTypeIdentifier]string{photo: values["photo"][1:]}
+	_, err = cred.AttributeValue(photo)
+	require.Equal(t, ErrorInvalidPreimage, err)
+
+	requested := values["photo"]
+	cred.Preimages = map[AttributeTypeIdentifier]string{photo: requested}
+	satisfied, result = DisclosedCredentialList{cred}.isAttributeSatisfied(photo, &requested, conf)
+	require.True(t, satisfied)
+	require.Equal(t, PRESENT, result.AttributeProofStatus)
+	require.Equal(t, values["address"], cred.GetAttributeValue(address))
+}
+
+func TestAttributeValueOrder(t *testing.T) {
+	credtype := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+	<SchemeManager>irma-demo</SchemeManager>
+	<IssuerID>MijnOverheid</IssuerID>
+	<CredentialID>ordered</CredentialID>
+	<Attributes>
+		<Attribute id="name"></Attribute>
+		<Attribute id="age" type="integer"></Attribute>
+		<Attribute id="birthdate" type="date"></Attribute>
+	</Attributes>
+</IssueSpecification>`), credtype))
+	conf, err := NewConfiguration("testdata/irma_configuration", "")
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	conf.CredentialTypes[credtype.Identifier()] = credtype
+	conf.addReverseHash(credtype.Identifier())
+	id := func(name string) AttributeTypeIdentifier {
+		return NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ordered." + name)
+	}
+
+	for _, c := range []struct {
+		attr, a, b string
+		cmp        int
+	}{
+		{"age", "9", "10", -1}, {"age", "010", "10", 0}, {"age", "-1", "-2", 1},
+		{"birthdate", "2017-12-31", "2018-01-01", -1}, {"birthdate", "2018-01-01", "2018-01-01", 0},
+	} {
+		cmp, err := conf.CompareAttributeValues(id(c.attr), c.a, c.b)
+		require.NoError(t, err)
+		require.Equal(t, c.cmp, cmp, "%s %s %s", c.attr, c.a, c.b)
+	}
+	_, err = conf.CompareAttributeValues(id("name"), "9", "10")
+	require.Error(t, err)
+	_, err = conf.CompareAttributeValues(id("age"), "9", "ten")
+	require.Error(t, err)
+	_, err = conf.CompareAttributeValues(id("nonexisting"), "9", "10")
+	require.Error(t, err)
+
+	// Invalid values are compared as strings
+	require.True(t, conf.AttributeValuesEqual(id("age"), "ten", "ten"))
+	require.False(t, conf.AttributeValuesEqual(id("age"), "ten", "10"))
+
+	// Invalid values are reported as such at issuance
+	credid := credtype.Identifier()
+	request := &CredentialRequest{CredentialTypeID: &credid, Attributes: map[string]string{
+		"name": "Alice", "age": "ten", "birthdate": "1976-02-29",
+	}}
+	_, err = request.AttributeList(conf, 0x03)
+	require.IsType(t, &InvalidAttributeValueError{}, err)
+	require.Equal(t, "age", err.(*InvalidAttributeValueError).Attribute)
+
+	// Typed getters of attribute lists of unknown credential types fail instead of panicking
+	list := NewAttributeListFromInts([]*big.Int{NewMetadataAttribute(0x03).Int}, conf)
+	_, err = list.IntegerAttribute(id("age"))
+	require.Error(t, err)
+}
+
 func TestTimestamp(t *testing.T) {
 	mytime := Timestamp(time.Unix(1500000000, 0))
 	timestruct := struct{ Time *Timestamp }{Time: &mytime}
@@ -238,3 +510,339 @@ func TestServiceProvider(t *testing.T) {
 
 	require.NotNil(t, spjwt.Request.Request.Content.Find(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
 }
+
+type countingRoundTripper struct {
+	count int
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPTransportRetries(t *testing.T) {
+	// A server that is unavailable for the first two requests of each path
+	var lock sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests[r.URL.Path]++
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case requests[r.URL.Path] <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`"ok"`))
+		}
+	}))
+	defer server.Close()
+
+	rt := &countingRoundTripper{}
+	options := HTTPTransportOptions{RoundTripper: rt, GetRetries: 2, GetRetryBackoff: time.Millisecond}
+	transport := NewHTTPTransportWithOptions(server.URL, options)
+
+	// GETs are retried
+	bts, err := transport.GetBytes("file")
+	require.NoError(t, err)
+	require.Equal(t, `"ok"`, string(bts))
+	require.Equal(t, 3, requests["/file"])
+	require.Equal(t, 3, rt.count)
+
+	// but not if retrying is pointless
+	_, err = transport.GetBytes("missing")
+	require.Error(t, err)
+	require.Equal(t, 1, requests["/missing"])
+
+	// or when we run out of retries
+	options.GetRetries = 1
+	_, err = NewHTTPTransportWithOptions(server.URL, options).GetBytes("other")
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, err.(*SessionError).Status)
+	require.Equal(t, 2, requests["/other"])
+
+	// POSTs are never retried
+	var result string
+	require.Error(t, transport.Post("post", &result, "message"))
+	require.Equal(t, 1, requests["/post"])
+}
+
+func TestHTTPTransportPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"ok"`))
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	get := func(url string, pins []string) error {
+		options := DefaultHTTPTransportOptions
+		options.RootCAs = roots
+		options.Pins = pins
+		options.GetRetries = 0
+		var result string
+		return NewHTTPTransportWithOptions(url, options).Get("file", &result)
+	}
+
+	// Without pins or with the pin of the server's key, the server is accepted
+	require.NoError(t, get(server.URL, nil))
+	require.NoError(t, get(server.URL, []string{"bm90IGEgcGluCg==", CertificatePin(server.Certificate())}))
+
+	// but not if its key is not pinned
+	err := get(server.URL, []string{"bm90IGEgcGluCg=="})
+	require.Error(t, err)
+	require.Equal(t, ErrorCertificatePinMismatch, err.(*SessionError).ErrorType)
+
+	// nor over plain http
+	err = get("http"+strings.TrimPrefix(server.URL, "https"), []string{CertificatePin(server.Certificate())})
+	require.Error(t, err)
+	require.Equal(t, ErrorCertificatePinMismatch, err.(*SessionError).ErrorType)
+
+	// Pins cannot be combined with a foreign RoundTripper, which would only let us check them after sending
+	options := DefaultHTTPTransportOptions
+	options.RoundTripper = server.Client().Transport
+	options.Pins = []string{CertificatePin(server.Certificate())}
+	var result string
+	err = NewHTTPTransportWithOptions(server.URL, options).Get("file", &result)
+	require.Error(t, err)
+	require.Equal(t, ErrorTransport, err.(*SessionError).ErrorType)
+
+	// but a pinned transport does not pick up a RoundTripper from the default options
+	defaults := DefaultHTTPTransportOptions
+	defer func() { DefaultHTTPTransportOptions = defaults }()
+	DefaultHTTPTransportOptions.RoundTripper = server.Client().Transport
+	DefaultHTTPTransportOptions.RootCAs = roots
+	DefaultHTTPTransportOptions.GetRetries = 0
+	require.NoError(t, NewPinnedHTTPTransport(server.URL, []string{CertificatePin(server.Certificate())}).Get("file", &result))
+	err = NewPinnedHTTPTransport(server.URL, []string{"bm90IGEgcGluCg=="}).Get("file", &result)
+	require.Error(t, err)
+	require.Equal(t, ErrorCertificatePinMismatch, err.(*SessionError).ErrorType)
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	events map[string][]LogFields
+}
+
+func (l *recordingLogger) Log(level LogLevel, event string, fields LogFields) {
+	l.Lock()
+	defer l.Unlock()
+	l.events[event] = append(l.events[event], fields)
+}
+
+func TestHTTPTransportLogging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","message":"secret-token","nested":[{"pin":"54321"}]}`))
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{events: map[string][]LogFields{}}
+	transport := NewHTTPTransport(server.URL)
+	transport.SetLogger(logger)
+	var result map[string]interface{}
+	require.NoError(t, transport.Post("verify", &result, map[string]string{"id": "user", "pin": "12345"}))
+	require.Equal(t, "secret-token", result["message"])
+
+	require.Len(t, logger.events["http.request"], 1)
+	require.Equal(t, server.URL+"/verify", logger.events["http.request"][0]["url"])
+	require.Equal(t, `{"id":"user","pin":"[redacted]"}`, logger.events["http.request"][0]["body"])
+	require.Len(t, logger.events["http.response"], 1)
+	require.Equal(t, http.StatusOK, logger.events["http.response"][0]["status"])
+	require.Len(t, logger.events["http.responseBody"], 1)
+	require.Equal(t,
+		`{"message":"[redacted]","nested":[{"pin":"[redacted]"}],"status":"success"}`,
+		logger.events["http.responseBody"][0]["body"],
+	)
+
+	// The bodies of session proofs and commitments are not logged at all
+	require.NoError(t, transport.Post("session/proofs", &result, map[string]string{"proof": "secret"}))
+	require.Len(t, logger.events["http.request"], 2)
+	require.Equal(t, "[not logged]", logger.events["http.request"][1]["body"])
+	require.Equal(t, "[not logged]", logger.events["http.responseBody"][1]["body"])
+
+	// Transports without logger of their own log to DefaultLogger
+	defer func(l Logger) { DefaultLogger = l }(DefaultLogger)
+	defaultLogger := &recordingLogger{events: map[string][]LogFields{}}
+	DefaultLogger = defaultLogger
+	require.NoError(t, NewHTTPTransport(server.URL).Get("status", &result))
+	require.Len(t, defaultLogger.events["http.request"], 1)
+	require.Len(t, logger.events["http.request"], 2)
+}
+
+func TestMessageTransports(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, "2.3", r.Header.Get("X-IRMA-ProtocolVersion"))
+			bts, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			w.Write(bts)
+		case "/status":
+			w.Write([]byte("CONNECTED"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":400,"error":"MALFORMED_INPUT","description":"Unknown path"}`))
+		}
+	})
+
+	check := func(transport SessionTransport) {
+		transport.SetHeader("X-IRMA-ProtocolVersion", "2.3")
+		var result map[string]int
+		require.NoError(t, transport.Post("echo", &result, map[string]int{"a": 1}))
+		require.Equal(t, map[string]int{"a": 1}, result)
+
+		var status string
+		require.NoError(t, transport.Get("status", &status))
+		require.Equal(t, "CONNECTED", status)
+
+		err := transport.Get("other", &status)
+		require.Error(t, err)
+		require.Equal(t, ErrorApi, err.(*SessionError).ErrorType)
+		require.Equal(t, "MALFORMED_INPUT", err.(*SessionError).ApiError.ErrorName)
+		transport.Delete()
+	}
+
+	check(NewLoopbackTransport(handler))
+
+	client, server := net.Pipe()
+	done := make(chan error)
+	go func() { done <- ServeStream(server, handler) }()
+	check(NewStreamTransport(client))
+	require.NoError(t, client.Close())
+	require.NoError(t, <-done)
+}
+
+func TestStreamTransportContext(t *testing.T) {
+	// The other end of the stream never responds
+	client, server := net.Pipe()
+	defer server.Close()
+	go ioutil.ReadAll(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := NewStreamTransport(client)
+	transport.SetContext(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	var status string
+	err := transport.Get("status", &status)
+	require.Error(t, err)
+	require.Equal(t, ErrorCancelled, err.(*SessionError).ErrorType)
+
+	// Afterwards the stream cannot be used anymore, as a response could still arrive
+	err = transport.Get("status", &status)
+	require.Error(t, err)
+	require.Equal(t, ErrorTransport, err.(*SessionError).ErrorType)
+	transport.Delete() // returns immediately
+
+	// The stream was closed, so that the transport does not remain blocked reading from it
+	_, err = server.Write([]byte{0})
+	require.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	v, err := ParseProtocolVersion("2.3")
+	require.NoError(t, err)
+	require.Equal(t, NewVersion(2, 3), v)
+	v, err = ParseProtocolVersion("10.12")
+	require.NoError(t, err)
+	require.Equal(t, "10.12", v.String())
+	require.Equal(t, 1, v.Compare(NewVersion(2, 3)))
+	require.Equal(t, -1, NewVersion(2, 3).Compare(NewVersion(2, 4)))
+	require.Equal(t, 0, NewVersion(2, 3).Compare(NewVersion(2, 3)))
+
+	for _, invalid := range []string{"", "2", "2.", ".3", "2.3.1", "2.x", "-2.3", "+2.3", " 2.3"} {
+		_, err = ParseProtocolVersion(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestProtocolVersionRange(t *testing.T) {
+	r, err := ParseProtocolVersionRange("2.0", "2.3")
+	require.NoError(t, err)
+	require.True(t, r.Contains(NewVersion(2, 0)))
+	require.True(t, r.Contains(NewVersion(2, 3)))
+	require.False(t, r.Contains(NewVersion(2, 4)))
+	require.False(t, r.Contains(NewVersion(1, 9)))
+	_, err = ParseProtocolVersionRange("2.3", "2.0")
+	require.Error(t, err)
+
+	other, err := ParseProtocolVersionRange("2.2", "3.1")
+	require.NoError(t, err)
+	require.Equal(t, &ProtocolVersionRange{Min: NewVersion(2, 2), Max: NewVersion(2, 3)}, r.Intersect(other))
+	require.Equal(t, r.Intersect(other), other.Intersect(r))
+	other, err = ParseProtocolVersionRange("3.0", "3.1")
+	require.NoError(t, err)
+	require.Nil(t, r.Intersect(other))
+	require.Nil(t, other.HighestSupported())
+
+	require.Equal(t, NewVersion(2, 3), r.HighestSupported())
+	require.Equal(t, SupportedProtocolVersions[0].Version, SupportedVersionRange().HighestSupported())
+}
+
+func TestProtocolFeatures(t *testing.T) {
+	require.Equal(t, byte(0x02), NewVersion(2, 2).Features().MetadataVersion)
+	require.Equal(t, byte(0x03), NewVersion(2, 3).Features().MetadataVersion)
+	require.False(t, NewVersion(2, 3).Features().ProofsMessage)
+
+	// Large attribute values are hashed, and their values sent along with our proofs, from 2.4
+	require.Equal(t, ProtocolFeatures{MetadataVersion: 0x04, ProofsMessage: true}, NewVersion(2, 4).Features())
+
+	// Versions that are not supported themselves get the features of the nearest lower supported version
+	require.Equal(t, NewVersion(2, 4).Features(), NewVersion(2, 9).Features())
+	require.Equal(t, NewVersion(2, 1).Features(), NewVersion(1, 0).Features())
+	var nilVersion *ProtocolVersion
+	require.Equal(t, NewVersion(2, 1).Features(), nilVersion.Features())
+}
+
+func TestParseSessionPointer(t *testing.T) {
+	expected := &Qr{
+		URL:                "https://example.com/irma/session/abc",
+		Type:               ActionDisclosing,
+		ProtocolVersion:    "2.0",
+		ProtocolMaxVersion: "2.3",
+	}
+	pointer := `{"u":"https://example.com/irma/session/abc","irmaqr":"disclosing","v":"2.0","vmax":"2.3"}`
+	escaped := url.QueryEscape(pointer)
+
+	for _, s := range []string{
+		pointer,
+		" " + pointer + "\n",
+		"irma://qr/json/" + url.PathEscape(pointer),
+		"intent://qr/json/" + url.PathEscape(pointer) + "#Intent;package=org.irmacard.cardemu;scheme=irma;end",
+		"https://irma.app/-/session#" + escaped,
+		"https://irma.app/-/session?qr=" + escaped,
+	} {
+		qr, err := ParseSessionPointer(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, qr, s)
+	}
+
+	// Legacy session pointers
+	qr, err := ParseSessionPointer(`{"u":"https://example.com/api/v2/signature/abc","v":"2.0"}`)
+	require.NoError(t, err)
+	require.Equal(t, ActionSigning, qr.Type)
+	require.Equal(t, "2.0", qr.ProtocolMaxVersion)
+	qr, err = ParseSessionPointer(`{"u":"https://example.com/irma_configuration/irma-demo","irmaqr":"schememanager"}`)
+	require.NoError(t, err)
+	require.Equal(t, ActionSchemeManager, qr.Type)
+
+	for _, s := range []string{
+		"",
+		"not a pointer",
+		"https://irma.app/-/session",
+		`{"u":"https://example.com/abc","irmaqr":"disclosing","v":"2","vmax":"2.3"}`,
+		`{"u":"https://example.com/abc","irmaqr":"disclosing","v":"2.0","vmax":"10"}`,
+		`{"u":"https://example.com/abc","irmaqr":"disclosing","v":"2.3","vmax":"2.1"}`,
+		`{"u":"https://example.com/abc","irmaqr":"unknown","v":"2.0","vmax":"2.3"}`,
+		`{"u":"https://example.com/abc","v":"2.0","vmax":"2.3"}`,
+		`{"irmaqr":"disclosing","v":"2.0","vmax":"2.3"}`,
+	} {
+		_, err = ParseSessionPointer(s)
+		require.Error(t, err, s)
+	}
+}
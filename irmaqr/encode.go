@@ -0,0 +1,68 @@
+// Package irmaqr renders IRMA session pointers (irma.Qr) as QR codes: as PNG or SVG images,
+// or as text for terminals. The codes are encoded using github.com/skip2/go-qrcode.
+package irmaqr
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/skip2/go-qrcode"
+)
+
+// Level is the error correction level of a QR code: the higher it is, the more of the
+// code can be damaged or obscured while it can still be read, but the larger the code.
+type Level int
+
+// Error correction levels, allowing respectively about 7%, 15%, 25% and 30% of the code to be damaged
+const (
+	LevelLow Level = iota
+	LevelMedium
+	LevelQuartile
+	LevelHigh
+)
+
+var recoveryLevels = map[Level]qrcode.RecoveryLevel{
+	LevelLow:      qrcode.Low,
+	LevelMedium:   qrcode.Medium,
+	LevelQuartile: qrcode.High,
+	LevelHigh:     qrcode.Highest,
+}
+
+// Code is a QR code: a square of dark and light modules.
+type Code struct {
+	// Size is the amount of modules along each side of the code, excluding the quiet zone.
+	Size int
+
+	modules [][]bool
+}
+
+// Encode returns the QR code of the session pointer.
+func Encode(qr *irma.Qr, level Level) (*Code, error) {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeBytes(bts, level)
+}
+
+// EncodeBytes returns the smallest QR code at the specified error correction level
+// that contains the data.
+func EncodeBytes(data []byte, level Level) (*Code, error) {
+	recoveryLevel, ok := recoveryLevels[level]
+	if !ok {
+		return nil, errors.New("Invalid error correction level")
+	}
+	code, err := qrcode.New(string(data), recoveryLevel)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Cannot encode QR code", 0)
+	}
+	code.DisableBorder = true // We draw the quiet zone ourselves
+	modules := code.Bitmap()
+	return &Code{Size: len(modules), modules: modules}, nil
+}
+
+// Dark returns whether or not the module at column x and row y is dark.
+func (code *Code) Dark(x, y int) bool {
+	return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.modules[y][x]
+}
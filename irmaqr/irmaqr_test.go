@@ -0,0 +1,134 @@
+package irmaqr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeVersion(t *testing.T) {
+	// Byte mode capacities of versions 1, 2 and 40 at the low and high levels
+	for _, c := range []struct {
+		length int
+		level  Level
+		size   int
+	}{
+		{17, LevelLow, 21}, {18, LevelLow, 25}, {32, LevelLow, 25},
+		{7, LevelHigh, 21}, {8, LevelHigh, 25},
+		{2953, LevelLow, 177}, {1273, LevelHigh, 177},
+	} {
+		code, err := EncodeBytes(make([]byte, c.length), c.level)
+		require.NoError(t, err)
+		require.Equal(t, c.size, code.Size, "%d bytes at level %d", c.length, c.level)
+	}
+
+	_, err := EncodeBytes(make([]byte, 2954), LevelLow)
+	require.Error(t, err)
+	_, err = EncodeBytes(make([]byte, 1274), LevelHigh)
+	require.Error(t, err)
+}
+
+func TestEncodeFunctionPatterns(t *testing.T) {
+	code, err := Encode(&irma.Qr{
+		URL:                "https://example.com/irma_api_server/api/v2/verification/abcdefghijklmnopqrstuvwxyz",
+		Type:               irma.ActionDisclosing,
+		ProtocolVersion:    "2.0",
+		ProtocolMaxVersion: "2.3",
+	}, LevelMedium)
+	require.NoError(t, err)
+	require.Equal(t, 0, (code.Size-17)%4)
+
+	// Finder patterns in three corners, surrounded by light separators
+	for _, corner := range [][2]int{{0, 0}, {code.Size - 7, 0}, {0, code.Size - 7}} {
+		for dy := -1; dy <= 7; dy++ {
+			for dx := -1; dx <= 7; dx++ {
+				dist := max(abs(dx-3), abs(dy-3))
+				require.Equal(t, dist != 2 && dist != 4, code.Dark(corner[0]+dx, corner[1]+dy))
+			}
+		}
+	}
+
+	// Timing patterns
+	for i := 8; i < code.Size-8; i++ {
+		require.Equal(t, i%2 == 0, code.Dark(i, 6))
+		require.Equal(t, i%2 == 0, code.Dark(6, i))
+	}
+
+	// Both copies of the format information are equal
+	var first, second int
+	for i := 0; i <= 5; i++ {
+		first |= bit(code.Dark(8, i)) << uint(i)
+	}
+	first |= bit(code.Dark(8, 7))<<6 | bit(code.Dark(8, 8))<<7 | bit(code.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		first |= bit(code.Dark(14-i, 8)) << uint(i)
+	}
+	for i := 0; i < 8; i++ {
+		second |= bit(code.Dark(code.Size-1-i, 8)) << uint(i)
+	}
+	for i := 8; i < 15; i++ {
+		second |= bit(code.Dark(8, code.Size-15+i)) << uint(i)
+	}
+	require.Equal(t, first, second)
+	require.Equal(t, 0, (first^0x5412)>>13) // The format bits of level M are 00
+}
+
+func TestRender(t *testing.T) {
+	code, err := EncodeBytes([]byte("irma"), LevelLow)
+	require.NoError(t, err)
+	total := code.Size + 2*QuietZone
+
+	_, err = code.PNG(total - 1)
+	require.Error(t, err)
+	bts, err := code.PNG(300)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	require.Equal(t, 300, img.Bounds().Dx())
+	require.Equal(t, 300, img.Bounds().Dy())
+	scale := 300 / total
+	offset := (300 - code.Size*scale) / 2
+	for _, p := range [][2]int{{0, 0}, {offset - 1, offset - 1}, {offset + scale, offset + scale}} {
+		r, _, _, _ := img.At(p[0], p[1]).RGBA()
+		require.Equal(t, uint32(0xFFFF), r, "pixel %v", p)
+	}
+	r, _, _, _ := img.At(offset, offset).RGBA()
+	require.Equal(t, uint32(0), r)
+
+	bts, err = code.SVG(300)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `width="300" height="300"`)
+	require.Contains(t, string(bts), "M4,4h1v1h-1z")
+
+	lines := strings.Split(strings.TrimSuffix(code.Unicode(), "\n"), "\n")
+	require.Len(t, lines, (total+1)/2)
+	for _, line := range lines {
+		require.Len(t, []rune(line), total)
+	}
+	require.Len(t, strings.Split(strings.TrimSuffix(code.ANSI(), "\n"), "\n"), total)
+}
+
+func bit(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,130 @@
+package irmaqr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/go-errors/errors"
+)
+
+// QuietZone is the width in modules of the light border drawn around codes,
+// which scanners need to locate the code.
+var QuietZone = 4
+
+// Image returns the code as a black and white image of size by size pixels, including the
+// quiet zone. So that all modules are equally large, the code is centered in the image with
+// its quiet zone widened as necessary. The size must be at least the amount of modules.
+func (code *Code) Image(size int) (image.Image, error) {
+	scale := size / (code.Size + 2*QuietZone)
+	if scale < 1 {
+		return nil, errors.Errorf("Image size too small, must be at least %d pixels", code.Size+2*QuietZone)
+	}
+	offset := (size - code.Size*scale) / 2
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.White
+			if x >= offset && y >= offset && code.Dark((x-offset)/scale, (y-offset)/scale) {
+				c = color.Black
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// PNG returns the code as a PNG image of size by size pixels (see Image()).
+func (code *Code) PNG(size int) ([]byte, error) {
+	img, err := code.Image(size)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG returns the code as an SVG image of size by size pixels, including the quiet zone.
+// As SVG images scale without loss, any size larger than zero is allowed.
+func (code *Code) SVG(size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, errors.New("Image size must be positive")
+	}
+	total := code.Size + 2*QuietZone
+	var path bytes.Buffer
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Dark(x, y) {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+QuietZone, y+QuietZone)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		size, size, total, total)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n")
+	fmt.Fprintf(&buf, `<path d="%s" fill="#000000"/>`+"\n", path.String())
+	fmt.Fprintf(&buf, "</svg>\n")
+	return buf.Bytes(), nil
+}
+
+// Unicode returns the code as lines of text, including the quiet zone, using block characters
+// that each cover two modules above each other. The light modules are drawn, so that the code
+// is shown correctly in terminals with light text on a dark background; use ANSI() for terminals
+// in which this is not the case.
+func (code *Code) Unicode() string {
+	var buf bytes.Buffer
+	for y := -QuietZone; y < code.Size+QuietZone; y += 2 {
+		for x := -QuietZone; x < code.Size+QuietZone; x++ {
+			upper := !code.Dark(x, y)
+			lower := !code.Dark(x, y+1) && y+1 < code.Size+QuietZone
+			switch {
+			case upper && lower:
+				buf.WriteString("█")
+			case upper:
+				buf.WriteString("▀")
+			case lower:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// ANSI returns the code as lines of text, including the quiet zone, drawing each module as
+// two spaces with a black or white background using ANSI escape codes. This shows the code
+// correctly regardless of the colors of the terminal, but takes up more space than Unicode().
+func (code *Code) ANSI() string {
+	const (
+		white = "\x1b[47m"
+		black = "\x1b[40m"
+		reset = "\x1b[0m"
+	)
+	var buf bytes.Buffer
+	for y := -QuietZone; y < code.Size+QuietZone; y++ {
+		current := ""
+		for x := -QuietZone; x < code.Size+QuietZone; x++ {
+			next := white
+			if code.Dark(x, y) {
+				next = black
+			}
+			if next != current {
+				buf.WriteString(next)
+				current = next
+			}
+			buf.WriteString("  ")
+		}
+		buf.WriteString(reset + "\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaqr"
+	"github.com/spf13/cobra"
+)
+
+// startCmd represents the start command
+var startCmd = &cobra.Command{
+	Use:   "start (disclose|sign|issue) path_to_request",
+	Short: "Start an IRMA session",
+	Long: `Start an IRMA session at an IRMA API server, print the session pointer for an IRMA app to scan, and wait for the session to finish.
+
+The request file contains a disclosure, signature or issuance request in JSON (use - to read it from standard input). It is sent to the server in an unsigned JWT, so the server must accept those from the requestor name.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url, err := cmd.Flags().GetString("url")
+		if err != nil {
+			return err
+		}
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			return err
+		}
+		showQr, err := cmd.Flags().GetBool("qr")
+		if err != nil {
+			return err
+		}
+		ansi, err := cmd.Flags().GetBool("ansi")
+		if err != nil {
+			return err
+		}
+
+		jwt, path, err := requestorJwt(args[0], args[1], name)
+		if err != nil {
+			return err
+		}
+		url = strings.TrimSuffix(url, "/") + "/" + path
+		transport := irma.NewHTTPTransport(url)
+
+		// Start the session, and show the session pointer
+		qr := &irma.Qr{}
+		if err = transport.Post("", qr, jwt); err != nil {
+			return err
+		}
+		token := qr.URL
+		qr.URL = url + "/" + token
+		if err = printQr(qr, showQr, ansi); err != nil {
+			return err
+		}
+
+		// Wait for the session to finish, and print its result
+		status, err := waitForSession(transport, token)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Session finished with status", status)
+		if status != "DONE" {
+			os.Exit(1)
+		}
+		var result json.RawMessage
+		switch path {
+		case "verification":
+			err = transport.Get(token+"/getproof", &result)
+		case "signature":
+			err = transport.Get(token+"/getsignature", &result)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(result))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(startCmd)
+	startCmd.Flags().StringP("url", "u", "http://localhost:8088/irma_api_server/api/v2/", "URL of the IRMA API server")
+	startCmd.Flags().StringP("name", "n", "irmasession", "requestor name to include in the JWT")
+	startCmd.Flags().Bool("qr", false, "print the session pointer as a QR code")
+	startCmd.Flags().Bool("ansi", false, "draw the QR code using ANSI colors instead of Unicode blocks, for terminals with a light background")
+}
+
+// requestorJwt reads the session request of the specified type from the file, and returns it
+// as an unsigned JWT, along with the path of the server endpoint for the session type.
+func requestorJwt(sessiontype, filename, name string) (string, string, error) {
+	var bts []byte
+	var err error
+	if filename == "-" {
+		bts, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bts, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var jwt interface{}
+	var path string
+	switch sessiontype {
+	case "disclose":
+		request := &irma.DisclosureRequest{}
+		err = json.Unmarshal(bts, request)
+		jwt, path = irma.NewServiceProviderJwt(name, request), "verification"
+	case "sign":
+		request := &irma.SignatureRequest{}
+		err = json.Unmarshal(bts, request)
+		jwt, path = irma.NewSignatureRequestorJwt(name, request), "signature"
+	case "issue":
+		request := &irma.IssuanceRequest{}
+		err = json.Unmarshal(bts, request)
+		jwt, path = irma.NewIdentityProviderJwt(name, request), "issue"
+	default:
+		return "", "", errors.Errorf("Unknown session type %s, must be disclose, sign or issue", sessiontype)
+	}
+	if err != nil {
+		return "", "", errors.WrapPrefix(err, "Failed to parse session request", 0)
+	}
+
+	unsigned, err := irma.UnsignedJwt(jwt)
+	return unsigned, path, err
+}
+
+// printQr prints the session pointer, as a QR code if requested.
+func printQr(qr *irma.Qr, showQr, ansi bool) error {
+	if !showQr {
+		bts, err := json.Marshal(qr)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bts))
+		return nil
+	}
+	code, err := irmaqr.Encode(qr, irmaqr.LevelLow)
+	if err != nil {
+		return err
+	}
+	if ansi {
+		fmt.Print(code.ANSI())
+	} else {
+		fmt.Print(code.Unicode())
+	}
+	return nil
+}
+
+// waitForSession polls the status of the session until it is finished, returning its final status.
+func waitForSession(transport *irma.HTTPTransport, token string) (string, error) {
+	for {
+		var status string
+		if err := transport.Get(token+"/status", &status); err != nil {
+			return "", err
+		}
+		status = strings.Trim(status, "\" \n")
+		switch status {
+		case "DONE", "CANCELLED", "TIMEOUT":
+			return status, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+const disclosureRequest = `{"content":[{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID"]}]}`
+
+func writeRequest(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "irmasession")
+	require.NoError(t, err)
+	filename := filepath.Join(dir, "request.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0600))
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestRequestorJwt(t *testing.T) {
+	filename, cleanup := writeRequest(t, disclosureRequest)
+	defer cleanup()
+
+	for sessiontype, expected := range map[string]struct{ path, field string }{
+		"disclose": {"verification", "sprequest"},
+		"sign":     {"signature", "absrequest"},
+		"issue":    {"issue", "iprequest"},
+	} {
+		jwt, path, err := requestorJwt(sessiontype, filename, "testrequestor")
+		require.NoError(t, err)
+		require.Equal(t, expected.path, path)
+
+		parts := strings.Split(jwt, ".")
+		require.Len(t, parts, 3)
+		require.Empty(t, parts[2])
+		header, err := base64.RawStdEncoding.DecodeString(parts[0])
+		require.NoError(t, err)
+		require.JSONEq(t, `{"alg":"none","typ":"JWT"}`, string(header))
+		body, err := base64.RawStdEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var contents map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &contents))
+		require.Equal(t, "testrequestor", contents["iss"])
+		require.Contains(t, contents, expected.field)
+	}
+
+	_, _, err := requestorJwt("revoke", filename, "testrequestor")
+	require.Error(t, err)
+	_, _, err = requestorJwt("disclose", filename+".nonexisting", "testrequestor")
+	require.Error(t, err)
+
+	invalid, cleanupInvalid := writeRequest(t, `{"content":`)
+	defer cleanupInvalid()
+	_, _, err = requestorJwt("disclose", invalid, "testrequestor")
+	require.Error(t, err)
+}
+
+// Start a disclosure session at a fake API server, which finishes it immediately.
+func TestStartSession(t *testing.T) {
+	filename, cleanup := writeRequest(t, disclosureRequest)
+	defer cleanup()
+
+	var lock sync.Mutex
+	var requests []string
+	var jwt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/verification/":
+			bts, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			jwt = string(bts)
+			require.NoError(t, json.NewEncoder(w).Encode(&irma.Qr{
+				URL: "token", Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3",
+			}))
+		case "/verification/token/status":
+			w.Write([]byte(`"DONE"`))
+		case "/verification/token/getproof":
+			w.Write([]byte(`"proofjwt"`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, args := range [][]string{{}, {"--qr"}, {"--qr", "--ansi"}} {
+		requests = nil
+		RootCmd.SetArgs(append([]string{"start", "disclose", filename, "--url", server.URL}, args...))
+		require.NoError(t, RootCmd.Execute(), "%v", args)
+		require.Equal(t, []string{
+			"POST /verification/",
+			"GET /verification/token/status",
+			"GET /verification/token/getproof",
+		}, requests)
+		expected, _, err := requestorJwt("disclose", filename, "irmasession")
+		require.NoError(t, err)
+		require.Equal(t, strings.Split(expected, ".")[0], strings.Split(jwt, ".")[0])
+	}
+}
+
+func TestPrintQr(t *testing.T) {
+	qr := &irma.Qr{URL: "https://example.com/irma/token", Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.3"}
+	for _, args := range [][2]bool{{false, false}, {true, false}, {true, true}} {
+		require.NoError(t, printQr(qr, args[0], args[1]))
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/privacybydesign/irmago/irmasession/cmd"
+
+func main() {
+	cmd.Execute()
+}
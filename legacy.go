@@ -117,3 +117,25 @@ type androidLogSignature struct {
 	androidLogVerification
 	Message string `json:"message"`
 }
+
+// upgradeLegacy fills in the fields of session pointers of old IRMA API servers, which lack the
+// session type or the maximum protocol version. The session type then follows from the URL,
+// and the maximum protocol version equals the minimum one.
+func (qr *Qr) upgradeLegacy() {
+	if qr.ProtocolMaxVersion == "" {
+		qr.ProtocolMaxVersion = qr.ProtocolVersion
+	}
+	if qr.Type != "" {
+		return
+	}
+	for _, part := range strings.Split(qr.URL, "/") {
+		switch part {
+		case "verification":
+			qr.Type = ActionDisclosing
+		case "signature":
+			qr.Type = ActionSigning
+		case "issue":
+			qr.Type = ActionIssuing
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package irma
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// LogLevel is the severity of a log event.
+type LogLevel int
+
+// Log levels, in increasing severity
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+// LogFields contains the structured data of a log event.
+type LogFields map[string]interface{}
+
+// Logger receives the log events of this library. Each event has a level, a name identifying
+// the kind of event (e.g. "http.request" or "scheme.download"), and structured fields.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, event string, fields LogFields)
+}
+
+// LoggerFunc is an adapter to use ordinary functions as Logger.
+type LoggerFunc func(level LogLevel, event string, fields LogFields)
+
+// DefaultLogger receives the log events of Configuration, HTTPTransport and Client instances
+// that have no logger set of their own. By default nothing is logged.
+var DefaultLogger Logger = nopLogger{}
+
+// RedactedLogFields are the keys of JSON objects in HTTP messages of which the values are
+// replaced by "[redacted]" before the messages are logged. Keys are compared case-insensitively.
+// Keyshare servers identify their users by email address, which they call the username.
+var RedactedLogFields = []string{"pin", "oldpin", "newpin", "token", "message", "email", "username"}
+
+// UnloggedBodyPaths are the final path segments of HTTP requests of which neither the request
+// nor the response body is logged: the proofs and commitments that we send in sessions disclose
+// attribute values, and the issuer's signatures and keyshare responses are of no use in logs.
+var UnloggedBodyPaths = []string{"proofs", "commitments", "getCommitments", "getResponse"}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, LogFields) {}
+
+// Log calls f(level, event, fields).
+func (f LoggerFunc) Log(level LogLevel, event string, fields LogFields) {
+	f(level, event, fields)
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarning:
+		return "warning"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// logEvent sends the event to the logger if not nil, and to DefaultLogger otherwise.
+func logEvent(logger Logger, level LogLevel, event string, fields LogFields) {
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	if logger == nil {
+		return
+	}
+	logger.Log(level, event, fields)
+}
+
+// Log sends the event to the logger of the configuration (or to DefaultLogger if it has none).
+func (conf *Configuration) Log(level LogLevel, event string, fields LogFields) {
+	var logger Logger
+	if conf != nil {
+		logger = conf.Logger
+	}
+	logEvent(logger, level, event, fields)
+}
+
+// logBody returns the body of a request to or response from the specified URL path for logging:
+// nothing if its path is one of UnloggedBodyPaths, and the redacted body otherwise.
+func logBody(path string, body []byte) string {
+	for _, unlogged := range UnloggedBodyPaths {
+		if path == unlogged || strings.HasSuffix(path, "/"+unlogged) {
+			return "[not logged]"
+		}
+	}
+	return redactBody(body)
+}
+
+// redactBody returns the body for logging, with the values of RedactedLogFields removed.
+// Bodies that are not JSON are not logged, as we cannot know what they contain.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "[not logged]"
+	}
+	bts, err := json.Marshal(redact(parsed))
+	if err != nil {
+		return "[not logged]"
+	}
+	return string(bts)
+}
+
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if isRedactedLogField(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redact(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redact(val)
+		}
+	}
+	return value
+}
+
+func isRedactedLogField(key string) bool {
+	for _, field := range RedactedLogFields {
+		if strings.EqualFold(key, field) {
+			return true
+		}
+	}
+	return false
+}
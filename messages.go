@@ -16,28 +16,6 @@ import (
 // Status encodes the status of an IRMA session (e.g., connected).
 type Status string
 
-// ProtocolVersion encodes the IRMA protocol version of an IRMA session.
-type ProtocolVersion struct {
-	major int
-	minor int
-}
-
-func NewVersion(major, minor int) *ProtocolVersion {
-	return &ProtocolVersion{major, minor}
-}
-
-func (v *ProtocolVersion) String() string {
-	return fmt.Sprintf("%d.%d", v.major, v.minor)
-}
-
-// Returns true if v is below the given version.
-func (v *ProtocolVersion) Below(major, minor int) bool {
-	if v.major < major {
-		return true
-	}
-	return v.major == major && v.minor < minor
-}
-
 // Action encodes the session type of an IRMA session (e.g., disclosing).
 type Action string
 
@@ -96,6 +74,7 @@ const (
 	StatusConnected     = Status("connected")
 	StatusCommunicating = Status("communicating")
 	StatusManualStarted = Status("manualStarted")
+	StatusRetryPending  = Status("retryPending")
 )
 
 // Actions
@@ -131,6 +110,8 @@ const (
 	ErrorServerResponse = ErrorType("serverResponse")
 	// Credential type not present in our Configuration
 	ErrorUnknownCredentialType = ErrorType("unknownCredentialType")
+	// Attribute value in an issuance request is invalid for the type of the attribute
+	ErrorInvalidAttributeValue = ErrorType("invalidAttributeValue")
 	// Error during downloading of credential type, issuer, or public keys
 	ErrorConfigurationDownload = ErrorType("configurationDownload")
 	// IRMA requests refers to unknown scheme manager
@@ -139,6 +120,16 @@ const (
 	ErrorInvalidSchemeManager = ErrorType("invalidSchemeManager")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
+	// Session was cancelled through its context
+	ErrorCancelled = ErrorType("cancelled")
+	// Deadline of the context of the session was exceeded
+	ErrorTimeout = ErrorType("timeout")
+	// Sending our response to the server failed, and retrying it was given up
+	ErrorRetryAbandoned = ErrorType("retryAbandoned")
+	// Server certificate did not match any of the pinned keys of the server
+	ErrorCertificatePinMismatch = ErrorType("certificatePinMismatch")
+	// Attributes contained as hash cannot be disclosed in the session, as our response cannot carry their values
+	ErrorHashedAttribute = ErrorType("hashedAttribute")
 )
 
 func (e *SessionError) Error() string {
@@ -178,6 +169,20 @@ func JwtDecode(jwt string, body interface{}) error {
 	return json.Unmarshal(bodybytes, body)
 }
 
+// UnsignedJwt returns the contents as a JWT without signature (i.e., using the "none" algorithm),
+// as accepted by IRMA API servers from requestors that are allowed to send unsigned requests.
+func UnsignedJwt(contents interface{}) (string, error) {
+	headerbytes, err := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	bodybytes, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(headerbytes) + "." + base64.RawStdEncoding.EncodeToString(bodybytes) + ".", nil
+}
+
 func ParseRequestorJwt(action Action, jwt string) (RequestorJwt, error) {
 	var retval RequestorJwt
 	switch action {
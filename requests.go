@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/asn1"
 	"fmt"
-	"log"
 	"math/big"
 	"strconv"
 	"time"
@@ -141,7 +140,7 @@ func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte) (*C
 	if err != nil {
 		return nil, err
 	}
-	return NewCredentialInfo(list.Ints, conf), nil
+	return list.Info(), nil
 }
 
 // AttributeList returns the list of attributes from this credential request.
@@ -175,25 +174,46 @@ func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion
 		}
 	}
 
+	// From metadata version 0x04 the attribute size determines which values are hashed;
+	// before that values larger than it cannot be encoded, so we refuse them
+	pk, err := conf.PublicKey(cr.CredentialTypeID.IssuerIdentifier(), cr.KeyCounter)
+	if err != nil && meta.Version() >= 0x04 {
+		return nil, err
+	}
+	size, sizeErr := AttributeSize(pk, meta.Version())
+	if sizeErr != nil && meta.Version() >= 0x04 {
+		return nil, sizeErr
+	}
+
 	attrs := make([]*big.Int, len(credtype.Attributes)+1)
 	attrs[0] = meta.Int
+	preimages := map[int]string{}
 	for i, attrtype := range credtype.Attributes {
 		attrs[i+1] = new(big.Int)
 		if str, present := cr.Attributes[attrtype.ID]; present {
-			// Set attribute to str << 1 + 1
-			attrs[i+1].SetBytes([]byte(str))
-			if meta.Version() >= 0x03 {
-				attrs[i+1].Lsh(attrs[i+1], 1)             // attr <<= 1
-				attrs[i+1].Add(attrs[i+1], big.NewInt(1)) // attr += 1
+			if err := attrtype.ValidateValue(str); err != nil {
+				return nil, err
+			}
+			var hashed bool
+			attrs[i+1], hashed = encodeAttribute(str, meta.Version(), size)
+			if hashed {
+				preimages[i] = str
+			} else if sizeErr == nil && len(str) > size {
+				return nil, attrtype.invalidValue("value of %d bytes exceeds the maximum of %d bytes under metadata version %#x",
+					len(str), size, meta.Version())
 			}
 		} else {
-			if (attrtype.Optional != "true") {
+			if attrtype.Optional != "true" {
 				return nil, errors.New("Required attribute not provided")
 			}
 		}
 	}
 
-	return NewAttributeListFromInts(attrs, conf), nil
+	list := NewAttributeListFromInts(attrs, conf)
+	if len(preimages) > 0 {
+		list.Preimages = preimages
+	}
+	return list, nil
 }
 
 func (ir *IssuanceRequest) Identifiers() *IrmaIdentifierSet {
@@ -296,7 +316,7 @@ func (sr *SignatureRequest) GetNonce() *big.Int {
 	// TODO the 2 should be abstracted away
 	asn1bytes, err := asn1.Marshal([]interface{}{big.NewInt(2), sr.Nonce, hashint})
 	if err != nil {
-		log.Print(err) // TODO? does this happen?
+		logEvent(nil, LogLevelError, "request.nonce", LogFields{"error": err.Error()}) // TODO? does this happen?
 	}
 	asn1hash := sha256.Sum256(asn1bytes)
 	return new(big.Int).SetBytes(asn1hash[:])
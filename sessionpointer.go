@@ -0,0 +1,75 @@
+package irma
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// ParseSessionPointer parses a session pointer, i.e. the contents of an IRMA QR code, into a Qr
+// that can be passed to irmaclient.Client.NewSession(). It accepts:
+//   - the JSON of the Qr itself, e.g. {"u":"https://...","irmaqr":"disclosing","v":"2.0","vmax":"2.3"};
+//   - links containing it URL-encoded, such as irma://qr/json/... deep links, and https universal
+//     links containing it in their fragment, query or path;
+//   - legacy session pointers lacking the session type or the maximum protocol version.
+//
+// The session type and protocol versions of the resulting Qr are checked using Validate().
+func ParseSessionPointer(pointer string) (*Qr, error) {
+	pointer = strings.TrimSpace(pointer)
+	if !strings.HasPrefix(pointer, "{") {
+		var err error
+		if pointer, err = extractSessionPointer(pointer); err != nil {
+			return nil, err
+		}
+	}
+
+	qr := &Qr{}
+	if err := json.Unmarshal([]byte(pointer), qr); err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid session pointer", 0)
+	}
+	qr.upgradeLegacy()
+	if err := qr.Validate(); err != nil {
+		return nil, err
+	}
+	return qr, nil
+}
+
+// Validate checks that the Qr has a server URL and a supported session type and, except in
+// scheme manager sessions, that its protocol versions are valid and form a nonempty range.
+func (qr *Qr) Validate() error {
+	if qr.URL == "" {
+		return errors.New("Session pointer has no server URL")
+	}
+	switch qr.Type {
+	case ActionSchemeManager:
+		return nil
+	case ActionDisclosing, ActionSigning, ActionIssuing: // nop
+	default:
+		return errors.Errorf("Session pointer has unsupported session type %q", qr.Type)
+	}
+
+	_, err := ParseProtocolVersionRange(qr.ProtocolVersion, qr.ProtocolMaxVersion)
+	return err
+}
+
+// extractSessionPointer returns the JSON session pointer contained URL-encoded in the link.
+func extractSessionPointer(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Invalid session pointer", 0)
+	}
+	query, err := url.QueryUnescape(u.RawQuery)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Invalid session pointer", 0)
+	}
+
+	for _, candidate := range []string{u.Fragment, query, u.Path, u.Opaque} {
+		start, end := strings.Index(candidate, "{"), strings.LastIndex(candidate, "}")
+		if start >= 0 && end > start {
+			return candidate[start : end+1], nil
+		}
+	}
+	return "", errors.New("Link contains no session pointer")
+}
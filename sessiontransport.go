@@ -0,0 +1,307 @@
+package irma
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-errors/errors"
+)
+
+// SessionTransport is the channel over which an interactive IRMA session with a requestor runs:
+// the session request is fetched with Get("jwt"), the response is sent with Post("proofs") or
+// Post("commitments"), and the session is aborted with Delete(). HTTPTransport is the default
+// implementation; MessageTransport allows sessions to run over other channels.
+// The errors returned by implementations are of type *SessionError.
+type SessionTransport interface {
+	Get(url string, result interface{}) error
+	Post(url string, result interface{}, object interface{}) error
+	Delete()
+	SetHeader(name, val string)
+	SetContext(ctx context.Context)
+}
+
+var _ SessionTransport = (*HTTPTransport)(nil)
+var _ SessionTransport = (*MessageTransport)(nil)
+
+// MaxStreamMessageSize is the maximum size in bytes of messages read from a stream
+// (see NewStreamTransport() and ServeStream()).
+var MaxStreamMessageSize = 16 << 20
+
+// MessageTransport is a SessionTransport that exchanges each request and its response
+// with the requestor as a message, e.g. in-memory or over a stream.
+type MessageTransport struct {
+	headers  map[string]string
+	ctx      context.Context
+	exchange func(ctx context.Context, request *transportRequest) (*transportResponse, error)
+	abort    func() // If set, called when an exchange is aborted to stop it, e.g. by closing a stream
+
+	// Protects headers and ctx
+	settingsLock sync.Mutex
+	// Prevents concurrent exchanges, and protects broken
+	lock sync.Mutex
+	// Set when an exchange was aborted, after which the channel cannot be used anymore
+	broken error
+}
+
+// transportRequest is the message that a MessageTransport sends for each request.
+type transportRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+// transportResponse is the message that a MessageTransport receives in response to a request.
+type transportResponse struct {
+	Status int    `json:"status"`
+	Body   []byte `json:"body,omitempty"`
+}
+
+// messageResponseWriter is the http.ResponseWriter passed to handlers serving
+// the requests of a MessageTransport.
+type messageResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+var errTransportBroken = errors.New("Transport unusable after an aborted request")
+
+// NewLoopbackTransport returns a transport passing its requests in-memory to the handler,
+// which receives them with URL paths relative to "/" (e.g. "/jwt").
+// This allows running sessions against a requestor in the same process, e.g. in tests.
+func NewLoopbackTransport(handler http.Handler) *MessageTransport {
+	return newMessageTransport(func(ctx context.Context, request *transportRequest) (*transportResponse, error) {
+		return serveMessage(ctx, handler, request), nil
+	})
+}
+
+// NewStreamTransport returns a transport that sends its requests over the stream,
+// e.g. a Unix socket or a serial line, and reads the responses from it. Each message
+// is JSON, preceded by its length as a 4-byte big-endian integer. The requests are to be
+// served at the other end of the stream, e.g. using ServeStream().
+// When a request is aborted because the context of the transport is done, the stream is
+// closed if it is an io.Closer. Otherwise the caller must close or otherwise end the stream
+// itself, as until then a goroutine of the transport remains blocked reading from it.
+func NewStreamTransport(stream io.ReadWriter) *MessageTransport {
+	transport := newMessageTransport(func(_ context.Context, request *transportRequest) (*transportResponse, error) {
+		if err := writeMessage(stream, request); err != nil {
+			return nil, err
+		}
+		response := &transportResponse{}
+		if err := readMessage(stream, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	})
+	if closer, ok := stream.(io.Closer); ok {
+		transport.abort = func() { _ = closer.Close() }
+	}
+	return transport
+}
+
+// ServeStream serves the requests of a stream transport (see NewStreamTransport()) at the
+// other end of the stream using the handler, until the stream is closed. It returns nil
+// if the stream was closed in between messages.
+func ServeStream(stream io.ReadWriter, handler http.Handler) error {
+	for {
+		request := &transportRequest{}
+		if err := readMessage(stream, request); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := writeMessage(stream, serveMessage(context.Background(), handler, request)); err != nil {
+			return err
+		}
+	}
+}
+
+func newMessageTransport(
+	exchange func(ctx context.Context, request *transportRequest) (*transportResponse, error),
+) *MessageTransport {
+	return &MessageTransport{
+		headers:  map[string]string{},
+		exchange: exchange,
+	}
+}
+
+// SetHeader sets a header to be sent in requests to the requestor.
+func (transport *MessageTransport) SetHeader(name, val string) {
+	transport.settingsLock.Lock()
+	defer transport.settingsLock.Unlock()
+	transport.headers[name] = val
+}
+
+// SetContext sets the context of the requests of this transport: when it is cancelled
+// or its deadline is exceeded, requests in progress are aborted, after which the
+// transport cannot be used anymore.
+func (transport *MessageTransport) SetContext(ctx context.Context) {
+	transport.settingsLock.Lock()
+	defer transport.settingsLock.Unlock()
+	transport.ctx = ctx
+}
+
+// Post sends the object to the requestor and parses its response into result.
+func (transport *MessageTransport) Post(url string, result interface{}, object interface{}) error {
+	return transport.jsonRequest(url, http.MethodPost, result, object)
+}
+
+// Get performs a GET request and parses the requestor's response into result.
+func (transport *MessageTransport) Get(url string, result interface{}) error {
+	return transport.jsonRequest(url, http.MethodGet, result, nil)
+}
+
+// Delete performs a DELETE.
+func (transport *MessageTransport) Delete() {
+	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
+}
+
+func (transport *MessageTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
+	body, isstr, err := marshalRequest(object)
+	if err != nil {
+		return err
+	}
+	request := &transportRequest{Method: method, URL: url, Headers: map[string]string{}, Body: body}
+	if body != nil {
+		if isstr {
+			request.Headers["Content-Type"] = "text/plain; charset=UTF-8"
+		} else {
+			request.Headers["Content-Type"] = "application/json; charset=UTF-8"
+		}
+	}
+	transport.settingsLock.Lock()
+	for name, val := range transport.headers {
+		request.Headers[name] = val
+	}
+	ctx := transport.ctx
+	transport.settingsLock.Unlock()
+
+	if ctx == nil || method == http.MethodDelete {
+		ctx = context.Background()
+	}
+	response, err := transport.do(ctx, request)
+	if err != nil {
+		return err
+	}
+	if method == http.MethodDelete {
+		return nil
+	}
+	statusMessage := fmt.Sprintf("%d %s", response.Status, http.StatusText(response.Status))
+	return parseResponse(response.Status, statusMessage, response.Body, result)
+}
+
+// do performs the exchange, aborting it if the context is done first.
+func (transport *MessageTransport) do(ctx context.Context, request *transportRequest) (*transportResponse, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if transport.broken != nil {
+		return nil, &SessionError{ErrorType: ErrorTransport, Err: transport.broken}
+	}
+
+	type result struct {
+		response *transportResponse
+		err      error
+	}
+	c := make(chan result, 1)
+	go func() {
+		response, err := transport.exchange(ctx, request)
+		c <- result{response, err}
+	}()
+
+	select {
+	case r := <-c:
+		if r.err != nil {
+			// We don't know how much of the messages was sent or received
+			transport.broken = errTransportBroken
+			return nil, &SessionError{ErrorType: ErrorTransport, Err: r.err}
+		}
+		return r.response, nil
+	case <-ctx.Done():
+		transport.broken = errTransportBroken
+		if transport.abort != nil {
+			transport.abort()
+		}
+		return nil, ContextError(ctx)
+	}
+}
+
+// serveMessage passes the request to the handler, returning its response.
+func serveMessage(ctx context.Context, handler http.Handler, request *transportRequest) *transportResponse {
+	req, err := http.NewRequest(request.Method, "/"+request.URL, bytes.NewReader(request.Body))
+	if err != nil {
+		return &transportResponse{Status: http.StatusBadRequest}
+	}
+	req = req.WithContext(ctx)
+	for name, val := range request.Headers {
+		req.Header.Set(name, val)
+	}
+
+	w := &messageResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return &transportResponse{Status: w.status, Body: w.body.Bytes()}
+}
+
+func (w *messageResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *messageResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *messageResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// writeMessage writes the message to the stream as JSON, preceded by its length.
+func writeMessage(stream io.Writer, message interface{}) error {
+	bts, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(bts) > MaxStreamMessageSize {
+		return errors.Errorf("Message of %d bytes exceeds maximum message size", len(bts))
+	}
+	frame := make([]byte, 4+len(bts))
+	binary.BigEndian.PutUint32(frame, uint32(len(bts)))
+	copy(frame[4:], bts)
+	_, err = stream.Write(frame)
+	return err
+}
+
+// readMessage reads a message written by writeMessage() from the stream into message.
+// It returns io.EOF only if the stream ended before the message started.
+func readMessage(stream io.Reader, message interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if uint64(size) > uint64(MaxStreamMessageSize) {
+		return errors.Errorf("Message of %d bytes exceeds maximum message size", size)
+	}
+	bts := make([]byte, size)
+	if _, err := io.ReadFull(stream, bts); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(bts, message)
+}
@@ -1,17 +1,24 @@
 package irma
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/disable_sigpipe"
 	"github.com/privacybydesign/irmago/internal/fs"
 )
@@ -21,19 +28,120 @@ type HTTPTransport struct {
 	Server  string
 	client  *http.Client
 	headers map[string]string
+	ctx     context.Context
+
+	getRetries      int
+	getRetryBackoff time.Duration
+	pins            []string
+	logger          Logger
+	err             error // If set, all requests fail with this error
+}
+
+// HTTPTransportOptions configure the HTTP client of a HTTPTransport, and the retrying of
+// GET requests by its GetBytes() and GetFile() methods. POST requests are never retried.
+type HTTPTransportOptions struct {
+	// Client to use for all requests. If nil, a client is created using the RoundTripper and Timeout.
+	Client *http.Client
+	// RoundTripper of the client to create, e.g. to use a proxy or custom root CAs.
+	// If nil, a http.Transport is used that dials with a SIGPIPE handler (which is only active on iOS).
+	RoundTripper http.RoundTripper
+	// Root CAs of the client to create, if it uses our own RoundTripper. If nil, the system CAs are used.
+	RootCAs *x509.CertPool
+	// Timeout of the client to create.
+	Timeout time.Duration
+	// SPKI pins (see CertificatePin()) of which at least one must match one of the certificates of
+	// the server. This is enforced during the TLS handshake, i.e., before any request is sent, which
+	// requires our own RoundTripper: if Client or RoundTripper is set as well, all requests fail.
+	// Requests to plain http URLs fail too.
+	Pins []string
+	// Amount of times that a failed GET request is retried, if the server could not be reached
+	// or was temporarily unavailable.
+	GetRetries int
+	// Time that we wait before the first retry of a GET request, which doubles with each subsequent retry.
+	GetRetryBackoff time.Duration
 }
 
-const verbose = false
+// DefaultHTTPTransportOptions are the options of the transports created by NewHTTPTransport(),
+// which is used for all HTTP requests of this library.
+var DefaultHTTPTransportOptions = HTTPTransportOptions{
+	Timeout:         15 * time.Second,
+	GetRetries:      2,
+	GetRetryBackoff: 500 * time.Millisecond,
+}
 
-// NewHTTPTransport returns a new HTTPTransport.
+// NewHTTPTransport returns a new HTTPTransport using DefaultHTTPTransportOptions.
 func NewHTTPTransport(serverURL string) *HTTPTransport {
+	return NewHTTPTransportWithOptions(serverURL, DefaultHTTPTransportOptions)
+}
+
+// NewPinnedHTTPTransport returns a new HTTPTransport using DefaultHTTPTransportOptions, that only
+// accepts servers having a certificate matching one of the specified SPKI pins, if any. In that
+// case any Client or RoundTripper in DefaultHTTPTransportOptions is not used, as the pins could
+// not be enforced with them.
+func NewPinnedHTTPTransport(serverURL string, pins []string) *HTTPTransport {
+	options := DefaultHTTPTransportOptions
+	options.Pins = pins
+	if len(pins) > 0 {
+		options.Client, options.RoundTripper = nil, nil
+	}
+	return NewHTTPTransportWithOptions(serverURL, options)
+}
+
+// NewHTTPTransportWithOptions returns a new HTTPTransport using the specified options.
+func NewHTTPTransportWithOptions(serverURL string, options HTTPTransportOptions) *HTTPTransport {
 	url := serverURL
 	if serverURL != "" && !strings.HasSuffix(url, "/") { // TODO fix this
 		url += "/"
 	}
 
-	// Create a transport that dials with a SIGPIPE handler (which is only active on iOS)
+	var err error
+	client := options.Client
+	if len(options.Pins) > 0 && (client != nil || options.RoundTripper != nil) {
+		// We cannot check the pins before a request is sent using a foreign Client or RoundTripper
+		err = errors.New("Certificate pins cannot be enforced using a custom Client or RoundTripper")
+		client = nil
+	}
+	if client == nil {
+		roundTripper := options.RoundTripper
+		if roundTripper == nil || len(options.Pins) > 0 {
+			roundTripper = newDialingTransport(options.RootCAs, options.Pins)
+		}
+		client = &http.Client{
+			Timeout:   options.Timeout,
+			Transport: roundTripper,
+		}
+		if len(options.Pins) > 0 {
+			// Redirects must not lead us to servers that are not subject to the pins
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				if req.URL.Scheme != "https" {
+					return errors.New("Refusing redirect to non-https URL of pinned server")
+				}
+				return nil
+			}
+		}
+	}
+
+	return &HTTPTransport{
+		Server:          url,
+		headers:         map[string]string{},
+		client:          client,
+		getRetries:      options.GetRetries,
+		getRetryBackoff: options.GetRetryBackoff,
+		pins:            options.Pins,
+		err:             err,
+	}
+}
+
+// newDialingTransport creates a transport that dials with a SIGPIPE handler (which is only active on iOS),
+// and that only accepts servers having a certificate matching one of the specified pins, if any.
+func newDialingTransport(rootCAs *x509.CertPool, pins []string) *http.Transport {
 	var innerTransport http.Transport
+	innerTransport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	if len(pins) > 0 {
+		innerTransport.TLSClientConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return checkPins(pins, chains)
+		}
+	}
 
 	innerTransport.Dial = func(network, addr string) (c net.Conn, err error) {
 		c, err = net.Dial(network, addr)
@@ -46,14 +154,7 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 		return c, nil
 	}
 
-	return &HTTPTransport{
-		Server:  url,
-		headers: map[string]string{},
-		client: &http.Client{
-			Timeout:   time.Second * 15,
-			Transport: &innerTransport,
-		},
-	}
+	return &innerTransport
 }
 
 // SetHeader sets a header to be sent in requests.
@@ -61,13 +162,103 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers[name] = val
 }
 
+// SetLogger sets the logger receiving the requests and responses of this transport.
+// If not set or nil, DefaultLogger is used.
+func (transport *HTTPTransport) SetLogger(logger Logger) {
+	transport.logger = logger
+}
+
+// SetContext sets the context of the requests of this transport: when it is cancelled
+// or its deadline is exceeded, requests in progress are aborted. DELETE requests are
+// exempted, so that the server can still be informed of the session being aborted.
+func (transport *HTTPTransport) SetContext(ctx context.Context) {
+	transport.ctx = ctx
+}
+
+// ContextError returns the error with which a session is aborted when its context is done:
+// ErrorTimeout if the deadline of the context was exceeded, and ErrorCancelled otherwise.
+func ContextError(ctx context.Context) *SessionError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &SessionError{ErrorType: ErrorTimeout, Err: ctx.Err()}
+	}
+	return &SessionError{ErrorType: ErrorCancelled, Err: ctx.Err()}
+}
+
+// Temporary returns whether or not the failed request may succeed if it is performed again,
+// i.e., whether the server could not be reached or was temporarily unavailable.
+func (e *SessionError) Temporary() bool {
+	switch e.ErrorType {
+	case ErrorTransport:
+		return true
+	case ErrorServerResponse:
+		return e.Status >= 500
+	default:
+		return false
+	}
+}
+
+// CertificatePin returns the SPKI pin of the certificate: the base64 encoded SHA256 hash
+// of its DER-encoded SubjectPublicKeyInfo (as in HTTP Public Key Pinning, RFC 7469).
+func CertificatePin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+var errPinMismatch = errors.New("Server certificate does not match any of the pinned keys")
+
+// checkPins returns an error unless one of the certificates matches one of the pins.
+func checkPins(pins []string, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := CertificatePin(cert)
+			for _, p := range pins {
+				if p == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// isPinMismatch returns whether or not the error returned by http.Client.Do() was caused
+// by checkPins() during the TLS handshake.
+func isPinMismatch(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return err == errPinMismatch
+		}
+	}
+}
+
+func (transport *HTTPTransport) log(level LogLevel, event string, fields LogFields) {
+	logEvent(transport.logger, level, event, fields)
+}
+
 func (transport *HTTPTransport) request(
-	url string, method string, reader io.Reader, isstr bool,
+	url string, method string, body []byte, isstr bool,
 ) (response *http.Response, err error) {
+	if transport.err != nil {
+		return nil, &SessionError{ErrorType: ErrorTransport, Err: transport.err}
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
 	req, err := http.NewRequest(method, transport.Server+url, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	if len(transport.pins) > 0 && req.URL.Scheme != "https" {
+		transport.log(LogLevelError, "http.pinMismatch", LogFields{"method": method, "url": req.URL.String()})
+		return nil, &SessionError{ErrorType: ErrorCertificatePinMismatch, Err: errPinMismatch,
+			Info: "pinned server is not accessed over HTTPS"}
+	}
 
 	req.Header.Set("User-Agent", "irmago")
 	if reader != nil {
@@ -80,11 +271,34 @@ func (transport *HTTPTransport) request(
 	for name, val := range transport.headers {
 		req.Header.Set(name, val)
 	}
+	if transport.ctx != nil && method != http.MethodDelete {
+		req = req.WithContext(transport.ctx)
+	}
+
+	fields := LogFields{"method": method, "url": req.URL.String()}
+	if body != nil && !isstr {
+		fields["body"] = logBody(req.URL.Path, body)
+	}
+	transport.log(LogLevelDebug, "http.request", fields)
 
+	start := time.Now()
 	res, err := transport.client.Do(req)
 	if err != nil {
+		if transport.ctx != nil && transport.ctx.Err() != nil {
+			return nil, ContextError(transport.ctx)
+		}
+		if isPinMismatch(err) {
+			transport.log(LogLevelError, "http.pinMismatch", LogFields{"method": method, "url": req.URL.String()})
+			return nil, &SessionError{ErrorType: ErrorCertificatePinMismatch, Err: err}
+		}
+		transport.log(LogLevelWarning, "http.error", LogFields{
+			"method": method, "url": req.URL.String(), "duration": time.Since(start), "error": err.Error(),
+		})
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	transport.log(LogLevelDebug, "http.response", LogFields{
+		"method": method, "url": req.URL.String(), "duration": time.Since(start), "status": res.StatusCode,
+	})
 	return res, nil
 }
 
@@ -96,29 +310,12 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		panic("Cannot GET and also post an object")
 	}
 
-	var isstr bool
-	var reader io.Reader
-	if object != nil {
-		var objstr string
-		if objstr, isstr = object.(string); isstr {
-			reader = bytes.NewBuffer([]byte(objstr))
-		} else {
-			marshaled, err := json.Marshal(object)
-			if err != nil {
-				return &SessionError{ErrorType: ErrorSerialization, Err: err}
-			}
-			if verbose {
-				fmt.Printf("%s %s: %s\n", method, url, string(marshaled))
-			}
-			reader = bytes.NewBuffer(marshaled)
-		}
-	} else {
-		if verbose {
-			fmt.Printf("%s %s\n", method, url)
-		}
+	body, isstr, err := marshalRequest(object)
+	if err != nil {
+		return err
 	}
 
-	res, err := transport.request(url, method, reader, isstr)
+	res, err := transport.request(url, method, body, isstr)
 	if err != nil {
 		return err
 	}
@@ -126,42 +323,93 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &SessionError{ErrorType: ErrorServerResponse, Err: err, Status: res.StatusCode, StatusMessage: res.Status}
 	}
-	if res.StatusCode != 200 {
-		apierr := &ApiError{}
-		err = json.Unmarshal(body, apierr)
-		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
-			return &SessionError{ErrorType: ErrorServerResponse, Status: res.StatusCode, StatusMessage: res.Status}
-		}
-		if verbose {
-			fmt.Printf("ERROR: %+v\n", apierr)
-		}
-		return &SessionError{ErrorType: ErrorApi, Status: res.StatusCode, ApiError: apierr, StatusMessage: res.Status}
+	if res.StatusCode == 200 {
+		transport.log(LogLevelDebug, "http.responseBody", LogFields{"url": res.Request.URL.String(), "body": logBody(res.Request.URL.Path, body)})
+	}
+	err = parseResponse(res.StatusCode, res.Status, body, result)
+	if serr, ok := err.(*SessionError); ok && serr.ApiError != nil {
+		transport.log(LogLevelWarning, "http.apiError", LogFields{
+			"url": res.Request.URL.String(), "status": res.StatusCode, "error": serr.ApiError.ErrorName,
+			"description": serr.ApiError.Description,
+		})
 	}
+	return err
+}
 
-	if verbose {
-		fmt.Printf("RESPONSE: %s\n", string(body))
+// marshalRequest returns the body of a request sending the object, which is sent as is if it
+// is a string and as JSON otherwise.
+func marshalRequest(object interface{}) (body []byte, isstr bool, err error) {
+	if object == nil {
+		return nil, false, nil
 	}
-	if _, resultstr := result.(*string); resultstr {
-		*result.(*string) = string(body)
-	} else {
-		err = json.Unmarshal(body, result)
-		if err != nil {
-			return &SessionError{ErrorType: ErrorServerResponse, Err: err, Status: res.StatusCode, StatusMessage: res.Status}
+	if objstr, isstr := object.(string); isstr {
+		return []byte(objstr), true, nil
+	}
+	marshaled, err := json.Marshal(object)
+	if err != nil {
+		return nil, false, &SessionError{ErrorType: ErrorSerialization, Err: err}
+	}
+	return marshaled, false, nil
+}
+
+// parseResponse parses the body of a response with the specified status into result,
+// or into a SessionError if the status indicates an error.
+func parseResponse(status int, statusMessage string, body []byte, result interface{}) error {
+	if status == http.StatusNoContent {
+		return nil // Nothing to parse into result
+	}
+	if status != 200 {
+		apierr := &ApiError{}
+		err := json.Unmarshal(body, apierr)
+		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
+			return &SessionError{ErrorType: ErrorServerResponse, Status: status, StatusMessage: statusMessage}
 		}
+		return &SessionError{ErrorType: ErrorApi, Status: status, ApiError: apierr, StatusMessage: statusMessage}
 	}
 
+	if resultstr, ok := result.(*string); ok {
+		*resultstr = string(body)
+	} else if err := json.Unmarshal(body, result); err != nil {
+		return &SessionError{ErrorType: ErrorServerResponse, Err: err, Status: status, StatusMessage: statusMessage}
+	}
 	return nil
 }
 
+// GetBytes performs a GET request and returns the server's response, retrying the request
+// if the server could not be reached or was temporarily unavailable.
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
+	backoff := transport.getRetryBackoff
+	for attempt := 0; ; attempt++ {
+		b, err := transport.getBytes(url)
+		if err == nil {
+			return b, nil // Don't return a nil *SessionError as a non-nil error
+		}
+		if attempt >= transport.getRetries || !err.Temporary() {
+			return nil, err
+		}
+		if transport.ctx == nil {
+			time.Sleep(backoff)
+		} else {
+			select {
+			case <-time.After(backoff):
+			case <-transport.ctx.Done():
+				return nil, ContextError(transport.ctx)
+			}
+		}
+		backoff *= 2
+	}
+}
+
+func (transport *HTTPTransport) getBytes(url string) ([]byte, *SessionError) {
 	res, err := transport.request(url, http.MethodGet, nil, false)
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		return nil, err.(*SessionError)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, Status: res.StatusCode}
@@ -184,6 +432,61 @@ func (transport *HTTPTransport) GetFile(url string, dest string) error {
 	return fs.SaveFile(dest, b)
 }
 
+// GetEvents performs a GET request for a stream of server-sent events, passing the data of each
+// event to the handler until the handler returns false, the stream ends, or ctx is done.
+// Unlike other requests, the stream is not subject to the timeout of the transport.
+// If the server does not offer an event stream at the url, an error is returned.
+func (transport *HTTPTransport) GetEvents(ctx context.Context, url string, handler func(data string) bool) error {
+	streaming := *transport
+	streaming.client = &http.Client{Transport: transport.client.Transport, CheckRedirect: transport.client.CheckRedirect}
+	streaming.ctx = ctx
+	streaming.headers = map[string]string{"Accept": "text/event-stream"}
+	for name, val := range transport.headers {
+		streaming.headers[name] = val
+	}
+
+	res, err := streaming.request(url, http.MethodGet, nil, false)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return &SessionError{ErrorType: ErrorServerResponse, Status: res.StatusCode, StatusMessage: res.Status,
+			Info: "server offers no event stream"}
+	}
+
+	// Each event consists of lines of fields, ended by an empty line; we only use the data field
+	var data []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 && !handler(strings.Join(data, "\n")) {
+				return nil
+			}
+			data = nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if ctx.Err() != nil {
+		return ContextError(ctx)
+	}
+	if err = scanner.Err(); err != nil {
+		return &SessionError{ErrorType: ErrorTransport, Err: err}
+	}
+	return nil
+}
+
+// GetContext performs a GET request like Get(), but subject to ctx instead of the context
+// of the transport (see SetContext()).
+func (transport *HTTPTransport) GetContext(ctx context.Context, url string, result interface{}) error {
+	request := *transport
+	request.ctx = ctx
+	return request.jsonRequest(url, http.MethodGet, result, nil)
+}
+
 // Post sends the object to the server and parses its response into result.
 func (transport *HTTPTransport) Post(url string, result interface{}, object interface{}) error {
 	return transport.jsonRequest(url, http.MethodPost, result, object)
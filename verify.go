@@ -1,7 +1,6 @@
 package irma
 
 import (
-	"fmt"
 	"math/big"
 	"time"
 
@@ -31,10 +30,28 @@ type SignatureProofResult struct {
 	message string
 }
 
+// SignedMessage is an attribute-based signature, along with the signature request
+// (including its nonce and context) in response to which it was created. Together
+// these can be verified using VerifySig().
+type SignedMessage struct {
+	Request   *SignatureRequest `json:"request"`
+	Signature gabi.ProofList    `json:"signature"`
+	// Values of disclosed attributes that the credentials contain as hash (see AttributeSize())
+	Preimages map[AttributeTypeIdentifier]string `json:"preimages,omitempty"`
+}
+
+// ProofsMessage contains our proofs in disclosure and signature sessions from protocol version 2.4,
+// along with the values of disclosed attributes that the credentials contain as hash.
+type ProofsMessage struct {
+	Proofs    gabi.ProofList                     `json:"proofs"`
+	Preimages map[AttributeTypeIdentifier]string `json:"preimages,omitempty"`
+}
+
 // DisclosedCredential contains raw disclosed credentials, without any extra parsing information
 type DisclosedCredential struct {
 	metadataAttribute *MetadataAttribute
 	Attributes        map[AttributeTypeIdentifier]*big.Int
+	Preimages         map[AttributeTypeIdentifier]string // Values of attributes disclosed as hash
 }
 
 type DisclosedCredentialList []*DisclosedCredential
@@ -43,26 +60,33 @@ type DisclosedCredentialList []*DisclosedCredential
 // This is the case if:
 // attribute is contained in disclosed AND if a value is present: equal to that value
 // al can be nil if you don't want to include attribute status for proof
-func (disclosed DisclosedCredentialList) isAttributeSatisfied(attributeId AttributeTypeIdentifier, requestedValue *string) (bool, *AttributeResult) {
+func (disclosed DisclosedCredentialList) isAttributeSatisfied(attributeId AttributeTypeIdentifier, requestedValue *string, conf *Configuration) (bool, *AttributeResult) {
 	ar := AttributeResult{
 		AttributeId: attributeId,
 	}
 
 	for _, cred := range disclosed {
-		disclosedAttributeValue := cred.GetAttributeValue(attributeId)
+		value, err := cred.AttributeValue(attributeId)
+		if err != nil {
+			// Attribute is disclosed as hash, but its value is missing or does not match the hash
+			conf.Log(LogLevelWarning, "verify.preimage", LogFields{"attribute": attributeId.String(), "error": err.Error()})
+			ar.AttributeProofStatus = INVALID_VALUE
+			continue
+		}
 
 		// Continue to next credential if requested attribute isn't disclosed in this credential
-		if disclosedAttributeValue == "" {
+		if value == nil || *value == "" {
 			continue
 		}
+		disclosedAttributeValue := *value
 
 		// If this is the disclosed attribute, check if value matches
 		// Attribute is satisfied if:
 		// - Attribute is disclosed (i.e. not nil)
-		// - Value is empty OR value equal to disclosedValue
+		// - Value is empty OR value equal to disclosedValue, according to the type of the attribute
 		ar.AttributeValue = disclosedAttributeValue
 
-		if requestedValue == nil || disclosedAttributeValue == *requestedValue {
+		if requestedValue == nil || conf.AttributeValuesEqual(attributeId, disclosedAttributeValue, *requestedValue) {
 			ar.AttributeProofStatus = PRESENT
 			return true, &ar
 		} else {
@@ -73,7 +97,7 @@ func (disclosed DisclosedCredentialList) isAttributeSatisfied(attributeId Attrib
 	}
 
 	// If there is never a value assigned, then this attribute isn't disclosed, and thus missing
-	if ar.AttributeValue == "" {
+	if ar.AttributeValue == "" && ar.AttributeProofStatus != INVALID_VALUE {
 		ar.AttributeProofStatus = MISSING
 	}
 	return false, &ar
@@ -141,14 +165,29 @@ func (proofResult *ProofResult) ContainsAttribute(attrId AttributeTypeIdentifier
 	return false
 }
 
-// Get string value of disclosed attribute, or nil if request attribute isn't disclosed in this credential
+// Get string value of disclosed attribute, or "" if request attribute isn't disclosed in this credential
+// (or if it is disclosed as hash without matching preimage, see AttributeValue())
 func (cred *DisclosedCredential) GetAttributeValue(id AttributeTypeIdentifier) string {
-	attr := cred.Attributes[id]
-	if attr != nil {
-		return string(attr.Bytes())
+	value, err := cred.AttributeValue(id)
+	if value == nil || err != nil {
+		return ""
 	}
+	return *value
+}
 
-	return ""
+// AttributeValue decodes the value of the disclosed attribute, returning nil if it isn't disclosed
+// in this credential. If the credential contains the attribute as hash, an error is returned if
+// its preimage is missing (ErrorMissingPreimage) or does not match the hash (ErrorInvalidPreimage).
+func (cred *DisclosedCredential) AttributeValue(id AttributeTypeIdentifier) (*string, error) {
+	attr := cred.Attributes[id]
+	if attr == nil {
+		return nil, nil
+	}
+	var preimage *string
+	if value, present := cred.Preimages[id]; present {
+		preimage = &value
+	}
+	return decodeAttribute(attr, cred.metadataAttribute.Version(), preimage)
 }
 
 func (cred *DisclosedCredential) IsExpired() bool {
@@ -196,7 +235,7 @@ func extractPublicKeys(configuration *Configuration, proofList gabi.ProofList) (
 	return publicKeys, nil
 }
 
-func extractDisclosedCredentials(conf *Configuration, proofList gabi.ProofList) (DisclosedCredentialList, error) {
+func extractDisclosedCredentials(conf *Configuration, proofList gabi.ProofList, preimages map[AttributeTypeIdentifier]string) (DisclosedCredentialList, error) {
 	var credentials = make(DisclosedCredentialList, 0, len(proofList))
 
 	for _, v := range proofList {
@@ -204,6 +243,7 @@ func extractDisclosedCredentials(conf *Configuration, proofList gabi.ProofList)
 		case *gabi.ProofD:
 			proof := v.(*gabi.ProofD)
 			cred := NewDisclosedCredentialFromADisclosed(proof.ADisclosed, conf)
+			cred.Preimages = preimages
 			credentials = append(credentials, cred)
 		default:
 			return nil, errors.New("Cannot extract credentials from proof, not a disclosure proofD!")
@@ -237,11 +277,13 @@ func addExtraAttributes(disclosed DisclosedCredentialList, proofResult *ProofRes
 }
 
 // Check an gabi prooflist against a signature proofrequest
-func checkProofWithRequest(configuration *Configuration, proofList gabi.ProofList, sigRequest *SignatureRequest) *SignatureProofResult {
-	disclosed, err := extractDisclosedCredentials(configuration, proofList)
+func checkProofWithRequest(
+	configuration *Configuration, proofList gabi.ProofList, sigRequest *SignatureRequest, preimages map[AttributeTypeIdentifier]string,
+) *SignatureProofResult {
+	disclosed, err := extractDisclosedCredentials(configuration, proofList, preimages)
 
 	if err != nil {
-		fmt.Println(err)
+		configuration.Log(LogLevelWarning, "verify.failed", LogFields{"status": string(INVALID_CRYPTO), "error": err.Error()})
 		return &SignatureProofResult{
 			ProofResult: &ProofResult{
 				ProofStatus: INVALID_CRYPTO,
@@ -254,12 +296,14 @@ func checkProofWithRequest(configuration *Configuration, proofList gabi.ProofLis
 	// Return MISSING_ATTRIBUTES as proofstatus if one attribute is missing
 	// This status takes priority over 'EXPIRED'
 	if signatureProofResult.ProofStatus == MISSING_ATTRIBUTES {
+		configuration.Log(LogLevelInfo, "verify.failed", LogFields{"status": string(MISSING_ATTRIBUTES)})
 		return signatureProofResult
 	}
 
 	// If all disjunctions are satisfied, check if a credential is expired
 	if disclosed.IsExpired() {
 		signatureProofResult.ProofStatus = EXPIRED
+		configuration.Log(LogLevelInfo, "verify.failed", LogFields{"status": string(EXPIRED)})
 		return signatureProofResult
 	}
 
@@ -273,6 +317,7 @@ func verify(configuration *Configuration, proofList gabi.ProofList, context *big
 	// Extract public keys
 	pks, err := extractPublicKeys(configuration, proofList)
 	if err != nil {
+		configuration.Log(LogLevelWarning, "verify.failed", LogFields{"status": string(INVALID_CRYPTO), "error": err.Error()})
 		return false
 	}
 
@@ -281,6 +326,14 @@ func verify(configuration *Configuration, proofList gabi.ProofList, context *big
 
 // Verify a signature proof and check if the attributes match the attributes in the original request
 func VerifySig(configuration *Configuration, proofString string, sigRequest *SignatureRequest) *SignatureProofResult {
+	return VerifySigWithPreimages(configuration, proofString, sigRequest, nil)
+}
+
+// VerifySigWithPreimages verifies a signature proof like VerifySig(), using the preimages
+// for disclosed attributes that the credentials contain as hash (see AttributeSize()).
+func VerifySigWithPreimages(
+	configuration *Configuration, proofString string, sigRequest *SignatureRequest, preimages map[AttributeTypeIdentifier]string,
+) *SignatureProofResult {
 
 	// First, unmarshal proof and check if all the attributes in the proofstring match the signature request
 	var proofList gabi.ProofList
@@ -288,6 +341,7 @@ func VerifySig(configuration *Configuration, proofString string, sigRequest *Sig
 
 	err := proofList.UnmarshalJSON(proofBytes)
 	if err != nil {
+		configuration.Log(LogLevelInfo, "verify.failed", LogFields{"status": string(INVALID_SYNTAX), "error": err.Error()})
 		return &SignatureProofResult{
 			ProofResult: &ProofResult{
 				ProofStatus: INVALID_SYNTAX,
@@ -297,6 +351,7 @@ func VerifySig(configuration *Configuration, proofString string, sigRequest *Sig
 
 	// Now, cryptographically verify the signature
 	if !verify(configuration, proofList, sigRequest.GetContext(), sigRequest.GetNonce(), true) {
+		configuration.Log(LogLevelInfo, "verify.failed", LogFields{"status": string(INVALID_CRYPTO)})
 		return &SignatureProofResult{
 			ProofResult: &ProofResult{
 				ProofStatus: INVALID_CRYPTO,
@@ -305,5 +360,5 @@ func VerifySig(configuration *Configuration, proofString string, sigRequest *Sig
 	}
 
 	// Finally, check whether attribute values in proof satisfy the original signature request
-	return checkProofWithRequest(configuration, proofList, sigRequest)
+	return checkProofWithRequest(configuration, proofList, sigRequest, preimages)
 }
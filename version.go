@@ -0,0 +1,193 @@
+package irma
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// ProtocolVersion encodes the IRMA protocol version of an IRMA session.
+type ProtocolVersion struct {
+	major int
+	minor int
+}
+
+// ProtocolVersionRange is a nonempty range of protocol versions, including both of its ends.
+type ProtocolVersionRange struct {
+	Min *ProtocolVersion
+	Max *ProtocolVersion
+}
+
+// ProtocolFeatures are the parts of the IRMA protocol that differ per protocol version.
+type ProtocolFeatures struct {
+	// Version of the metadata attribute of credentials issued in the session, which determines the
+	// encoding of attributes: from 0x03 optional attributes can be absent, and from 0x04 values
+	// larger than the attribute size are hashed (see AttributeSize()).
+	MetadataVersion byte
+	// Whether or not our proofs in disclosure and signature sessions are sent in a ProofsMessage,
+	// along with the values of disclosed attributes that the credentials contain as hash.
+	ProofsMessage bool
+}
+
+// SupportedProtocolVersion is a protocol version implemented by irmago, along with its features.
+type SupportedProtocolVersion struct {
+	Version  *ProtocolVersion
+	Features ProtocolFeatures
+}
+
+// SupportedProtocolVersions are the protocol versions implemented by irmago, from highest to lowest.
+// Supporting a new protocol version, e.g. 3.0, amounts to implementing the features in which it
+// differs from the previous versions, and adding it here.
+var SupportedProtocolVersions = []SupportedProtocolVersion{
+	{NewVersion(2, 4), ProtocolFeatures{MetadataVersion: 0x04, ProofsMessage: true}},
+	{NewVersion(2, 3), ProtocolFeatures{MetadataVersion: 0x03}},
+	{NewVersion(2, 2), ProtocolFeatures{MetadataVersion: 0x02}},
+	{NewVersion(2, 1), ProtocolFeatures{MetadataVersion: 0x02}},
+}
+
+func NewVersion(major, minor int) *ProtocolVersion {
+	return &ProtocolVersion{major, minor}
+}
+
+func (v *ProtocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// Major returns the major version number, which changes on incompatible protocol changes.
+func (v *ProtocolVersion) Major() int {
+	return v.major
+}
+
+// Minor returns the minor version number.
+func (v *ProtocolVersion) Minor() int {
+	return v.minor
+}
+
+// ParseProtocolVersion parses a protocol version of the form "major.minor", e.g. "2.3".
+func ParseProtocolVersion(s string) (*ProtocolVersion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("Invalid protocol version %q", s)
+	}
+	major, err := parseVersionNumber(parts[0])
+	if err != nil {
+		return nil, errors.Errorf("Invalid protocol version %q", s)
+	}
+	minor, err := parseVersionNumber(parts[1])
+	if err != nil {
+		return nil, errors.Errorf("Invalid protocol version %q", s)
+	}
+	return NewVersion(major, minor), nil
+}
+
+// parseVersionNumber parses a nonnegative decimal number without sign or other characters.
+func parseVersionNumber(s string) (int, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, errors.New("Invalid version number")
+	}
+	return strconv.Atoi(s)
+}
+
+// Compare returns -1, 0 or 1 if v is respectively below, equal to, or above the other version.
+func (v *ProtocolVersion) Compare(other *ProtocolVersion) int {
+	switch {
+	case v.Below(other.major, other.minor):
+		return -1
+	case other.Below(v.major, v.minor):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Returns true if v is below the given version.
+func (v *ProtocolVersion) Below(major, minor int) bool {
+	if v.major < major {
+		return true
+	}
+	return v.major == major && v.minor < minor
+}
+
+// Features returns the features of the protocol version, i.e. those of the highest supported
+// version not above it. As sessions are only ever performed using supported versions, for other
+// versions this is a best effort. For nil, or versions below all supported versions, the features
+// of the lowest supported version are returned.
+func (v *ProtocolVersion) Features() ProtocolFeatures {
+	features := SupportedProtocolVersions[len(SupportedProtocolVersions)-1].Features
+	if v != nil {
+		for _, supported := range SupportedProtocolVersions {
+			if supported.Version.Compare(v) <= 0 {
+				features = supported.Features
+				break
+			}
+		}
+	}
+	return features
+}
+
+// NewVersionRange returns the range of versions from min to max, or an error if it is empty.
+func NewVersionRange(min, max *ProtocolVersion) (*ProtocolVersionRange, error) {
+	if max.Compare(min) < 0 {
+		return nil, errors.Errorf("Empty protocol version range %s - %s", min, max)
+	}
+	return &ProtocolVersionRange{Min: min, Max: max}, nil
+}
+
+// ParseProtocolVersionRange parses the range of versions between min and max,
+// which are of the form "major.minor".
+func ParseProtocolVersionRange(min, max string) (*ProtocolVersionRange, error) {
+	minVersion, err := ParseProtocolVersion(min)
+	if err != nil {
+		return nil, err
+	}
+	maxVersion, err := ParseProtocolVersion(max)
+	if err != nil {
+		return nil, err
+	}
+	return NewVersionRange(minVersion, maxVersion)
+}
+
+// SupportedVersionRange returns the range from the lowest to the highest supported protocol version.
+func SupportedVersionRange() *ProtocolVersionRange {
+	return &ProtocolVersionRange{
+		Min: SupportedProtocolVersions[len(SupportedProtocolVersions)-1].Version,
+		Max: SupportedProtocolVersions[0].Version,
+	}
+}
+
+func (r *ProtocolVersionRange) String() string {
+	return fmt.Sprintf("%s - %s", r.Min, r.Max)
+}
+
+// Contains returns whether or not the version is within the range.
+func (r *ProtocolVersionRange) Contains(v *ProtocolVersion) bool {
+	return v.Compare(r.Min) >= 0 && v.Compare(r.Max) <= 0
+}
+
+// Intersect returns the range of versions contained in both ranges, or nil if there are none.
+func (r *ProtocolVersionRange) Intersect(other *ProtocolVersionRange) *ProtocolVersionRange {
+	min, max := r.Min, r.Max
+	if other.Min.Compare(min) > 0 {
+		min = other.Min
+	}
+	if other.Max.Compare(max) < 0 {
+		max = other.Max
+	}
+	if max.Compare(min) < 0 {
+		return nil
+	}
+	return &ProtocolVersionRange{Min: min, Max: max}
+}
+
+// HighestSupported returns the highest supported protocol version within the range,
+// or nil if the range contains no supported version.
+func (r *ProtocolVersionRange) HighestSupported() *ProtocolVersion {
+	for _, supported := range SupportedProtocolVersions {
+		if r.Contains(supported.Version) {
+			return supported.Version
+		}
+	}
+	return nil
+}